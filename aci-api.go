@@ -16,7 +16,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/umisama/go-regexpcache"
@@ -29,6 +33,10 @@ import (
 
 var arrayExtension = regexpcache.MustCompile("^(?P<stage_1>.*)\\.\\[(?P<child_name>.*)\\](?P<stage_2>.*)")
 
+// The pod, node and tenant of a fault are parsed from the dn of the affected object
+var faultNodeRegex = regexpcache.MustCompile("^topology/pod-(?P<podid>[1-9][0-9]*)/node-(?P<nodeid>[1-9][0-9]*)/")
+var faultTenantRegex = regexpcache.MustCompile("^uni/tn-(?P<tenant>[^/]+)/")
+
 func newAciAPI(ctx context.Context, fabricConfig *Fabric, configQueries AllQueries, queryArray []string, node *string) *aciAPI {
 	executeQueries := queriesToExecute(configQueries, queryArray)
 
@@ -40,6 +48,8 @@ func newAciAPI(ctx context.Context, fabricConfig *Fabric, configQueries AllQueri
 		configCompoundQueries: executeQueries.CompoundClassQueries,
 		configGroupQueries:    executeQueries.GroupClassQueries,
 		configBuiltInQueries:  BuiltinQueries{},
+		queryStatus:           newQueryStatus(),
+		relabelConfigs:        configQueries.RelabelConfigs,
 	}
 
 	// Make sure all built in queries are handled
@@ -47,13 +57,20 @@ func newAciAPI(ctx context.Context, fabricConfig *Fabric, configQueries AllQueri
 		// If query parameter queries is used
 		for _, v := range queryArray {
 			if v == "faults" {
-				api.configBuiltInQueries["faults"] = api.faults
+				api.configBuiltInQueries["faults"] = aciAPI.faults
+			}
+			if v == "fault_instances" {
+				api.configBuiltInQueries["fault_instances"] = aciAPI.faultInstances
 			}
 			// Add all other builtin with if statements
 		}
 	} else {
 		// If query parameter queries is NOT used, include all
-		api.configBuiltInQueries["faults"] = api.faults
+		api.configBuiltInQueries["faults"] = aciAPI.faults
+		// fault_instances can create many series and is only included by default if enabled
+		if viper.GetBool("fault_instances.enabled") {
+			api.configBuiltInQueries["fault_instances"] = aciAPI.faultInstances
+		}
 	}
 
 	return api
@@ -67,6 +84,9 @@ type aciAPI struct {
 	configCompoundQueries CompoundClassQueries
 	configGroupQueries    GroupClassQueries
 	configBuiltInQueries  BuiltinQueries
+	queryStatus           *queryStatus
+	// relabelConfigs is the global relabel rules applied to the metrics of all queries
+	relabelConfigs []RelabelConfig
 }
 
 func queriesToExecute(configQueries AllQueries, queryArray []string) AllQueries {
@@ -78,6 +98,7 @@ func queriesToExecute(configQueries AllQueries, queryArray []string) AllQueries
 	executeQueries.ClassQueries = ClassQueries{}
 	executeQueries.CompoundClassQueries = CompoundClassQueries{}
 	executeQueries.GroupClassQueries = GroupClassQueries{}
+	executeQueries.RelabelConfigs = configQueries.RelabelConfigs
 
 	// Find the named queries for the different type
 	for _, queryName := range queryArray {
@@ -140,6 +161,9 @@ func (p aciAPI) CollectMetrics() (string, []MetricDefinition, error) {
 		metrics = append(metrics, <-ch...)
 	}
 
+	// The status of each executed query
+	queryMetrics := p.queryStatus.metrics()
+
 	end := time.Since(start)
 
 	if metrics == nil {
@@ -149,13 +173,17 @@ func (p aciAPI) CollectMetrics() (string, []MetricDefinition, error) {
 		metrics = append(metrics, *p.up(1.0))
 	}
 
+	metrics = append(metrics, queryMetrics...)
+
 	metrics = append(metrics, *p.scrape(end.Seconds()))
 	log.WithFields(log.Fields{
 		LogFieldRequestID: p.ctx.Value(LogFieldRequestID),
 		LogFieldExecTime:  end.Microseconds(),
 		LogFieldFabric:    fmt.Sprintf("%v", p.ctx.Value(LogFieldFabric)),
 	}).Info("total scrape time ")
-	return aciName, metrics, nil
+
+	// A query limit with the action fail fail the scrape, the metrics are still returned to show the exceeded limit
+	return aciName, metrics, p.queryStatus.err()
 }
 
 func (p aciAPI) scrape(seconds float64) *MetricDefinition {
@@ -198,8 +226,13 @@ func (p aciAPI) up(state float64) *MetricDefinition {
 func (p aciAPI) configuredBuiltInMetrics(chall chan []MetricDefinition) {
 	var metricDefinitions []MetricDefinition
 	ch := make(chan []MetricDefinition)
-	for _, fun := range p.configBuiltInQueries {
-		go fun(ch)
+	for name, fun := range p.configBuiltInQueries {
+		go func(name string, fun func(aciAPI) ([]MetricDefinition, error)) {
+			start := time.Now()
+			limited, state := p.withLimits(nil)
+			builtInMetricDefinitions, err := fun(limited)
+			ch <- p.queryDone(name, start, state, nil, builtInMetricDefinitions, err)
+		}(name, fun)
 	}
 
 	for range p.configBuiltInQueries {
@@ -209,15 +242,14 @@ func (p aciAPI) configuredBuiltInMetrics(chall chan []MetricDefinition) {
 	chall <- metricDefinitions
 }
 
-func (p aciAPI) faults(ch chan []MetricDefinition) {
+func (p aciAPI) faults() ([]MetricDefinition, error) {
 	data, err := p.connection.GetByQuery(p.ctx, "faults")
 	if err != nil {
 		log.WithFields(log.Fields{
 			LogFieldRequestID: p.ctx.Value(LogFieldRequestID),
 			LogFieldFabric:    fmt.Sprintf("%v", p.ctx.Value(LogFieldFabric)),
 		}).Error("faults not supported", err)
-		ch <- nil
-		return
+		return nil, err
 	}
 
 	metricDefinitionFaults := MetricDefinition{}
@@ -310,7 +342,61 @@ func (p aciAPI) faults(ch chan []MetricDefinition) {
 
 	metricDefinitionAcked.Metrics = metrics
 
-	ch <- []MetricDefinition{metricDefinitionFaults, metricDefinitionAcked}
+	return []MetricDefinition{metricDefinitionFaults, metricDefinitionAcked}, nil
+}
+
+// faultInstances return every fault instance as a series with the creation time of the fault as value
+func (p aciAPI) faultInstances() ([]MetricDefinition, error) {
+	data, err := p.connection.GetByClassQuery(p.ctx, "faultInst", viper.GetString("fault_instances.query_parameter"))
+	if err != nil {
+		log.WithFields(log.Fields{
+			LogFieldRequestID: p.ctx.Value(LogFieldRequestID),
+			LogFieldFabric:    fmt.Sprintf("%v", p.ctx.Value(LogFieldFabric)),
+		}).Error("fault instances not supported", err)
+		return nil, err
+	}
+
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "fault_instance_created_timestamp"
+	metricDefinition.Description = MetricDesc{
+		Help: "The creation time, as unix timestamp, of the fault",
+		Type: "gauge",
+		Unit: "seconds",
+	}
+
+	var metrics []Metric
+	gjson.Get(data, "imdata.#.faultInst.attributes").ForEach(func(key, value gjson.Result) bool {
+		attributes := value.Map()
+		// The fault dn is the dn of the affected object and the fault code, like topology/pod-1/node-101/.../fault-F0532
+		affected := strings.TrimSuffix(attributes["dn"].Str, "/fault-"+attributes["code"].Str)
+
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["code"] = attributes["code"].Str
+		metric.Labels["severity"] = attributes["severity"].Str
+		metric.Labels["lifecycle"] = attributes["lc"].Str
+		metric.Labels["acked"] = attributes["ack"].Str
+		metric.Labels["type"] = attributes["type"].Str
+		metric.Labels["domain"] = attributes["domain"].Str
+		metric.Labels["cause"] = attributes["cause"].Str
+		metric.Labels["affected"] = affected
+
+		for _, re := range []*regexp.Regexp{faultNodeRegex, faultTenantRegex} {
+			match := re.FindStringSubmatch(affected)
+			for i, expName := range re.SubexpNames() {
+				if i != 0 && expName != "" && len(match) != 0 {
+					metric.Labels[expName] = match[i]
+				}
+			}
+		}
+
+		metric.Value = p.toFloat(attributes["created"].Str)
+		metrics = append(metrics, metric)
+		return true
+	})
+
+	metricDefinition.Metrics = metrics
+	return []MetricDefinition{metricDefinition}, nil
 }
 
 func (p aciAPI) getAciName() (string, error) {
@@ -338,8 +424,8 @@ func (p aciAPI) getAciName() (string, error) {
 func (p aciAPI) configuredCompoundsMetrics(chall chan []MetricDefinition) {
 	var metricDefinitions []MetricDefinition
 	ch := make(chan []MetricDefinition)
-	for _, v := range p.configCompoundQueries {
-		go p.getCompoundMetrics(ch, v)
+	for name, v := range p.configCompoundQueries {
+		go p.getCompoundMetrics(ch, name, v)
 	}
 
 	for range p.configCompoundQueries {
@@ -349,38 +435,73 @@ func (p aciAPI) configuredCompoundsMetrics(chall chan []MetricDefinition) {
 	chall <- metricDefinitions
 }
 
-func (p aciAPI) getCompoundMetrics(ch chan []MetricDefinition, v *CompoundClassQuery) {
-	var metricDefinitions []MetricDefinition
-	metricDefinition := MetricDefinition{}
-	metricDefinition.Name = v.Metrics[0].Name
-	metricDefinition.Description.Help = v.Metrics[0].Help
-	metricDefinition.Description.Type = v.Metrics[0].Type
-	metricDefinition.Description.Unit = v.Metrics[0].Unit
+func (p aciAPI) getCompoundMetrics(ch chan []MetricDefinition, name string, v *CompoundClassQuery) {
+	start := time.Now()
+	p, state := p.withLimits(v.Limits)
+	var queryErr error
+	metricDefinitions := make([]MetricDefinition, len(v.Metrics))
+	for i, mv := range v.Metrics {
+		metricDefinitions[i].Name = mv.Name
+		metricDefinitions[i].Description.Help = mv.Help
+		metricDefinitions[i].Description.Type = mv.Type
+		metricDefinitions[i].Description.Unit = mv.Unit
+	}
 
-	var metrics []Metric
 	for _, classLabel := range v.ClassNames {
-		metric := Metric{}
-		data, _ := p.connection.GetByClassQuery(p.ctx, classLabel.Class, classLabel.QueryParameter)
-		if classLabel.ValueName == "" {
-			metric.Value = p.toFloat(gjson.Get(data, fmt.Sprintf("imdata.0.%s", v.Metrics[0].ValueName)).Str)
-		} else {
-			metric.Value = p.toFloat(gjson.Get(data, fmt.Sprintf("imdata.0.%s", classLabel.ValueName)).Str)
+		data, err := p.connection.GetByClassQuery(p.ctx, classLabel.Class, classLabel.QueryParameter)
+		if err != nil {
+			// The class is skipped, a failed class must not be exported as 0
+			queryErr = err
+			continue
+		}
+		for i, mv := range v.Metrics {
+			// The value name of the class is used for all metrics
+			valueName := mv.ValueName
+			if classLabel.ValueName != "" {
+				valueName = classLabel.ValueName
+			}
+			value, ok := p.compoundValue(data, valueName, mv.Aggregation)
+			if !ok {
+				continue
+			}
+			metric := Metric{}
+			metric.Value = value
+			metric.Labels = make(map[string]string)
+			metric.Labels[v.LabelName] = classLabel.Label
+			metricDefinitions[i].Metrics = append(metricDefinitions[i].Metrics, metric)
 		}
-		metric.Labels = make(map[string]string)
-		metric.Labels[v.LabelName] = classLabel.Label
-		metrics = append(metrics, metric)
 	}
-	metricDefinition.Metrics = metrics
-	metricDefinitions = append(metricDefinitions, metricDefinition)
-	ch <- metricDefinitions
+	ch <- p.queryDone(name, start, state, v.RelabelConfigs, metricDefinitions, queryErr)
+}
+
+// compoundValue return the value of the first row, or if aggregation is set, the aggregated value of all rows. The
+// count is the number of rows.
+func (p aciAPI) compoundValue(data string, valueName string, aggregation string) (float64, bool) {
+	if aggregation == "" {
+		return p.toFloat(gjson.Get(data, fmt.Sprintf("imdata.0.%s", valueName)).Str), true
+	}
+
+	rows := gjson.Get(data, "imdata").Array()
+	if aggregation == AggregationCount {
+		return float64(len(rows)), true
+	}
+
+	var values []float64
+	for _, row := range rows {
+		value := row.Get(valueName)
+		if value.Exists() {
+			values = append(values, p.toFloat(value.String()))
+		}
+	}
+	return aggregate(aggregation, values)
 }
 
 func (p aciAPI) configuredGroupMetrics(chall chan []MetricDefinition) {
 	var metricDefinitions []MetricDefinition
 	ch := make(chan []MetricDefinition)
 
-	for _, v := range p.configGroupQueries {
-		go p.getGroupClassMetrics(ch, *v)
+	for name, v := range p.configGroupQueries {
+		go p.getGroupClassMetrics(ch, name, *v)
 	}
 
 	for range p.configGroupQueries {
@@ -393,8 +514,8 @@ func (p aciAPI) configuredGroupMetrics(chall chan []MetricDefinition) {
 func (p aciAPI) configuredClassMetrics(chall chan []MetricDefinition) {
 	var metricDefinitions []MetricDefinition
 	ch := make(chan []MetricDefinition)
-	for _, v := range p.configQueries {
-		go p.getClassMetrics(ch, v)
+	for name, v := range p.configQueries {
+		go p.getClassMetrics(ch, name, v)
 	}
 
 	for range p.configQueries {
@@ -403,7 +524,10 @@ func (p aciAPI) configuredClassMetrics(chall chan []MetricDefinition) {
 
 	chall <- metricDefinitions
 }
-func (p aciAPI) getGroupClassMetrics(ch chan []MetricDefinition, v GroupClassQuery) {
+func (p aciAPI) getGroupClassMetrics(ch chan []MetricDefinition, name string, v GroupClassQuery) {
+	start := time.Now()
+	// The limits apply to all queries of the group
+	p, state := p.withLimits(v.Limits)
 	var metricDefinitions []MetricDefinition
 
 	metricDefinition := MetricDefinition{}
@@ -416,24 +540,30 @@ func (p aciAPI) getGroupClassMetrics(ch chan []MetricDefinition, v GroupClassQue
 	var metrics []Metric
 	metricDefinition.Metrics = metrics
 
-	chsub := make(chan []MetricDefinition)
+	type subQueryResult struct {
+		metricDefinitions []MetricDefinition
+		err               error
+	}
+	chsub := make(chan subQueryResult)
 
 	for _, query := range v.Queries {
-		// Need copy by value
-		queryValue := ClassQuery{
-			ClassName:      query.ClassName,
-			QueryParameter: query.QueryParameter,
-			Metrics:        query.Metrics,
-			Labels:         query.Labels,
-			StaticLabels:   query.StaticLabels,
-		}
+		// Need copy by value, all settings of the query, like the aggregation, are used as in the validate dry run
+		queryValue := query
 
-		go p.getClassMetrics(chsub, &queryValue)
+		go func(query *ClassQuery) {
+			md, err := p.classMetrics(query)
+			chsub <- subQueryResult{metricDefinitions: relabelMetrics(md, query.RelabelConfigs), err: err}
+		}(&queryValue)
 	}
 
+	// The group query is only successful if all queries are successful
+	var queryErr error
 	for range v.Queries {
-		md := <-chsub
-		for _, vx := range md {
+		result := <-chsub
+		if result.err != nil {
+			queryErr = result.err
+		}
+		for _, vx := range result.metricDefinitions {
 			for _, vy := range vx.Metrics {
 				// Add any static labels
 				for _, v := range v.StaticLabels {
@@ -445,12 +575,78 @@ func (p aciAPI) getGroupClassMetrics(ch chan []MetricDefinition, v GroupClassQue
 	}
 
 	metricDefinitions = append(metricDefinitions, metricDefinition)
-	ch <- metricDefinitions
+	ch <- p.queryDone(name, start, state, v.RelabelConfigs, metricDefinitions, queryErr)
 }
 
-func (p aciAPI) getClassMetrics(ch chan []MetricDefinition, v *ClassQuery) {
-
+func (p aciAPI) getClassMetrics(ch chan []MetricDefinition, name string, v *ClassQuery) {
+	start := time.Now()
+	p, state := p.withLimits(v.Limits)
 	var metricDefinitions []MetricDefinition
+	var err error
+	if data, ok := p.subscribedData(name, v); ok {
+		metricDefinitions = p.classMetricsFromData(v, data)
+	} else {
+		metricDefinitions, err = p.classMetrics(v)
+	}
+	ch <- p.queryDone(name, start, state, v.RelabelConfigs, metricDefinitions, err)
+}
+
+// withLimits return a copy of the api where the requests of the query are limited by the limits of the query, the
+// fabric and the global limits, in that order of precedence
+func (p aciAPI) withLimits(limits *QueryLimits) (aciAPI, *limitState) {
+	queryLimits := QueryLimits{}
+	if limits != nil {
+		queryLimits = *limits
+	}
+	state := newLimitState(queryLimits.merge(p.connection.fabricConfig.Limits).merge(globalLimits()))
+	p.ctx = context.WithValue(p.ctx, ContextKeyLimits, state)
+	return p, state
+}
+
+// queryDone apply the relabel rules of the query and the global relabel rules, and then the series limit, to the
+// metrics of the query, add the result of the query to the query status and return the metrics. A query that exceeded
+// a limit, and was not truncated, is dropped.
+func (p aciAPI) queryDone(name string, start time.Time, state *limitState, relabelConfigs []RelabelConfig,
+	metricDefinitions []MetricDefinition, err error) []MetricDefinition {
+	metricDefinitions = relabelMetrics(metricDefinitions, relabelConfigs)
+	metricDefinitions = relabelMetrics(metricDefinitions, p.relabelConfigs)
+
+	metricDefinitions, limitErr := state.series(metricDefinitions)
+	if limitErr != nil {
+		err = limitErr
+	}
+
+	var limitExceeded *LimitExceededError
+	if errors.As(err, &limitExceeded) {
+		metricDefinitions = nil
+	}
+
+	if exceeded := state.exceededLimits(); len(exceeded) > 0 {
+		log.WithFields(log.Fields{
+			LogFieldRequestID: p.ctx.Value(LogFieldRequestID),
+			LogFieldFabric:    fmt.Sprintf("%v", p.ctx.Value(LogFieldFabric)),
+			"query":           name,
+			"limits":          strings.Join(exceeded, ","),
+			"action":          state.limits.Action,
+		}).Warning("query limit exceeded")
+	}
+
+	p.queryStatus.add(name, start, metricDefinitions, err)
+	p.queryStatus.addLimits(name, state)
+	return metricDefinitions
+}
+
+// subscribedData return the objects of the query from the subscription store, if the query is subscribed and the
+// subscription is active
+func (p aciAPI) subscribedData(name string, v *ClassQuery) (string, bool) {
+	if subscriptionStore == nil || !v.Subscription || p.connection.Node != nil {
+		return "", false
+	}
+	return subscriptionStore.data(p.connection.fabricConfig.FabricName, name)
+}
+
+func (p aciAPI) classMetrics(v *ClassQuery) ([]MetricDefinition, error) {
+
 	data, err := p.connection.GetByClassQuery(p.ctx, v.ClassName, v.QueryParameter)
 
 	if err != nil {
@@ -458,10 +654,16 @@ func (p aciAPI) getClassMetrics(ch chan []MetricDefinition, v *ClassQuery) {
 			LogFieldRequestID: p.ctx.Value(LogFieldRequestID),
 			LogFieldFabric:    fmt.Sprintf("%v", p.ctx.Value(LogFieldFabric)),
 		}).Error(fmt.Sprintf("%s not supported", v.ClassName), err)
-		ch <- nil
-		return
+		return nil, err
 	}
 
+	return p.classMetricsFromData(v, data), nil
+}
+
+// classMetricsFromData extract the metrics of the class query from the response data
+func (p aciAPI) classMetricsFromData(v *ClassQuery, data string) []MetricDefinition {
+	var metricDefinitions []MetricDefinition
+
 	// For each metrics in the config
 	for _, mv := range v.Metrics {
 		metricDefinition := MetricDefinition{}
@@ -478,11 +680,12 @@ func (p aciAPI) getClassMetrics(ch chan []MetricDefinition, v *ClassQuery) {
 
 		metricDefinitions = append(metricDefinitions, metricDefinition)
 	}
-	ch <- metricDefinitions
+	return metricDefinitions
 }
 
 func (p aciAPI) extractClassQueriesData(data string, classQuery *ClassQuery, mv ConfigMetric, metrics []Metric) []Metric {
 	result := gjson.Get(data, "imdata")
+	joinTables := p.joinTables(classQuery.Joins)
 
 	result.ForEach(func(key, value gjson.Result) bool {
 
@@ -510,7 +713,15 @@ func (p aciAPI) extractClassQueriesData(data string, classQuery *ClassQuery, mv
 			for childIndex, child := range allChildren {
 				for childKey, childValue := range child {
 					// add a check if the childKey match the regexp of match[2]
-					re := regexpcache.MustCompile(match[2])
+					re, err := regexpcache.Compile(match[2])
+					if err != nil {
+						log.WithFields(log.Fields{
+							"error":      err,
+							"name":       mv.Name,
+							"value_name": mv.ValueName,
+						}).Error("value_name child expression")
+						return false
+					}
 
 					_, ok := childValue.(map[string]interface{})
 					if ok && re.Match([]byte(childKey)) {
@@ -530,6 +741,7 @@ func (p aciAPI) extractClassQueriesData(data string, classQuery *ClassQuery, mv
 
 						// Add all high level labels
 						addLabels(classQuery.Labels, classQuery.StaticLabels, value.String(), metric)
+						addJoinLabels(joinTables, classQuery.ClassName, value.String(), metric)
 
 						// Add all [*] labels that will be relative to the child key
 						// Rewrite them from the relative path and add them as Config labels
@@ -585,6 +797,36 @@ func (p aciAPI) extractClassQueriesData(data string, classQuery *ClassQuery, mv
 			// find and parse all labels
 			metric.Labels = make(map[string]string)
 			addLabels(classQuery.Labels, classQuery.StaticLabels, value.String(), metric)
+			addJoinLabels(joinTables, classQuery.ClassName, value.String(), metric)
+
+			if mv.Type == MetricTypeHistogram || mv.Type == MetricTypeSummary {
+				distribution, err := p.toDistribution(value.String(), mv)
+				if err != nil {
+					// skip the object but continue with the rest
+					return true
+				}
+				metric.Distribution = distribution
+				metric.Value = distribution.Sum
+				metrics = append(metrics, metric)
+				return true
+			}
+
+			// An info metric has the attributes as labels and the value 1
+			if mv.Type == MetricTypeInfo {
+				for _, attribute := range mv.Attributes {
+					metric.Labels[infoLabelName(attribute)] = gjson.Get(value.String(), attribute).String()
+				}
+				metric.Value = 1
+				metrics = append(metrics, metric)
+				return true
+			}
+
+			// A count of the objects do not need a value
+			if classQuery.Aggregation != nil && mv.Aggregation == AggregationCount && mv.ValueName == "" {
+				metric.Value = 1
+				metrics = append(metrics, metric)
+				return true
+			}
 
 			// get the metrics value
 			value, err := p.toFloatTransform(gjson.Get(value.String(), mv.ValueName).Str, mv)
@@ -598,12 +840,27 @@ func (p aciAPI) extractClassQueriesData(data string, classQuery *ClassQuery, mv
 
 		return true
 	})
+
+	// The node labels are joined before the aggregation so they can be used in group_by
+	metrics = nodeCache.join(fmt.Sprintf("%v", p.ctx.Value(LogFieldFabric)), metrics, classQuery.NodeJoin)
+
+	if classQuery.Aggregation != nil {
+		return aggregateMetrics(metrics, classQuery.Aggregation.GroupBy, classQuery.StaticLabels, mv.Aggregation)
+	}
 	return metrics
 }
 
 func addLabels(v []ConfigLabels, sv []StaticLabels, json string, metric Metric) {
 	for _, lv := range v {
-		re := regexpcache.MustCompile(lv.Regex)
+		re, err := regexpcache.Compile(lv.Regex)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":         err,
+				"property_name": lv.PropertyName,
+				"regex":         lv.Regex,
+			}).Error("label regex")
+			continue
+		}
 		match := re.FindStringSubmatch(gjson.Get(json, lv.PropertyName).Str)
 		if len(match) != 0 {
 			for i, expName := range re.SubexpNames() {
@@ -718,7 +975,16 @@ func (p aciAPI) toFloatTransform(value string, mv ConfigMetric) (float64, error)
 	}
 
 	if mv.ValueCalculation != "" && len(allValues) != 0 {
-		expression, _ := govaluate.NewEvaluableExpression(mv.ValueCalculation)
+		expression, err := govaluate.NewEvaluableExpression(mv.ValueCalculation)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":             err,
+				"name":              mv.Name,
+				"value_name":        mv.ValueName,
+				"value_calculation": mv.ValueCalculation,
+			}).Error("value_calculation")
+			return 0.0, err
+		}
 		parameters := make(map[string]interface{}, len(allFloats))
 
 		if len(allFloats) == 1 && allValueNames[0] == "" {
@@ -754,3 +1020,94 @@ func (p aciAPI) toFloatTransform(value string, mv ConfigMetric) (float64, error)
 
 	return allFloats[0], nil
 }
+
+// toDistribution extract the buckets or quantiles of a histogram or summary metric. The value transformations of the
+// metric are only applied to the sum
+func (p aciAPI) toDistribution(json string, mv ConfigMetric) (*Distribution, error) {
+	distribution := &Distribution{}
+
+	switch mv.Type {
+	case MetricTypeHistogram:
+		if len(mv.Buckets) == 0 {
+			err := fmt.Errorf("histogram must have buckets")
+			log.WithFields(log.Fields{
+				"error": err,
+				"name":  mv.Name,
+			}).Error("histogram")
+			return nil, err
+		}
+
+		upperBounds := make([]float64, 0, len(mv.Buckets))
+		values := make(map[float64]float64, len(mv.Buckets))
+		for _, bucket := range mv.Buckets {
+			upperBound, err := strconv.ParseFloat(bucket.UpperBound, 64)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+					"name":  mv.Name,
+					"le":    bucket.UpperBound,
+				}).Error("histogram bucket")
+				return nil, err
+			}
+			upperBounds = append(upperBounds, upperBound)
+			values[upperBound] = p.toFloat(gjson.Get(json, bucket.ValueName).Str)
+		}
+		sort.Float64s(upperBounds)
+
+		// Prometheus buckets are cumulative
+		distribution.Buckets = make(map[float64]float64, len(upperBounds)+1)
+		cumulative := 0.0
+		for _, upperBound := range upperBounds {
+			if mv.CumulativeBuckets {
+				cumulative = values[upperBound]
+			} else {
+				cumulative = cumulative + values[upperBound]
+			}
+			distribution.Buckets[upperBound] = cumulative
+		}
+
+		if mv.CountValueName != "" {
+			distribution.Count = p.toFloat(gjson.Get(json, mv.CountValueName).Str)
+		} else {
+			distribution.Count = cumulative
+		}
+		// The +Inf bucket is the count, and the count can not be less than the last bucket
+		if distribution.Count < cumulative {
+			log.WithFields(log.Fields{
+				"name":  mv.Name,
+				"count": distribution.Count,
+				"le":    upperBounds[len(upperBounds)-1],
+				"value": cumulative,
+			}).Warning("histogram count is less than the last bucket, the count is set to the bucket value")
+			distribution.Count = cumulative
+		}
+		distribution.Buckets[math.Inf(1)] = distribution.Count
+	case MetricTypeSummary:
+		if len(mv.Quantiles) == 0 {
+			err := fmt.Errorf("summary must have quantiles")
+			log.WithFields(log.Fields{
+				"error": err,
+				"name":  mv.Name,
+			}).Error("summary")
+			return nil, err
+		}
+
+		distribution.Quantiles = make(map[float64]float64, len(mv.Quantiles))
+		for _, quantile := range mv.Quantiles {
+			distribution.Quantiles[quantile.Quantile] = p.toFloat(gjson.Get(json, quantile.ValueName).Str)
+		}
+		if mv.CountValueName != "" {
+			distribution.Count = p.toFloat(gjson.Get(json, mv.CountValueName).Str)
+		}
+	}
+
+	if mv.SumValueName != "" {
+		sum, err := p.toFloatTransform(gjson.Get(json, mv.SumValueName).Str, mv)
+		if err != nil {
+			return nil, err
+		}
+		distribution.Sum = sum
+	}
+
+	return distribution, nil
+}
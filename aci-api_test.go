@@ -0,0 +1,37 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestToDistributionCount(t *testing.T) {
+	mv := ConfigMetric{
+		Name: "latency",
+		Type: MetricTypeHistogram,
+		Buckets: []ConfigBucket{
+			{UpperBound: "1", ValueName: "attributes.b1"},
+			{UpperBound: "2", ValueName: "attributes.b2"},
+		},
+		CountValueName: "attributes.count",
+	}
+	distribution, err := aciAPI{}.toDistribution(`{"attributes":{"b1":"3","b2":"4","count":"2"}}`, mv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if distribution.Count != 7 || distribution.Buckets[math.Inf(1)] != 7 {
+		t.Errorf("expected count and +Inf bucket 7 from the last bucket, got %g and %g", distribution.Count,
+			distribution.Buckets[math.Inf(1)])
+	}
+}
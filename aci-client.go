@@ -19,7 +19,6 @@ import (
 	"io"
 	"net/http"
 	"strings"
-	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -30,7 +29,7 @@ type AciClient interface {
 	Get(ctx context.Context, url string) ([]byte, int, error)
 }
 
-func NewAciClient(client http.Client, headers map[string]string, token *AciToken, fabricName string, url string) AciClient {
+func NewAciClient(client http.Client, headers map[string]string, token *AciToken, signer *AciSigner, fabricName string, url string) AciClient {
 
 	if strings.Contains(url, "order-by") {
 		if viper.GetBool("HTTPClient.parallel_paging") {
@@ -46,6 +45,7 @@ func NewAciClient(client http.Client, headers map[string]string, token *AciToken
 			Client:     client,
 			Headers:    headers,
 			Token:      token,
+			Signer:     signer,
 			FabricName: fabricName,
 			PageSize:   viper.GetInt("HTTPClient.pagesize"),
 		}
@@ -55,6 +55,7 @@ func NewAciClient(client http.Client, headers map[string]string, token *AciToken
 		Client:     client,
 		Headers:    headers,
 		Token:      token,
+		Signer:     signer,
 		FabricName: fabricName,
 	}
 }
@@ -63,11 +64,12 @@ type AciClientSequential struct {
 	Client     http.Client
 	Headers    map[string]string
 	Token      *AciToken
+	Signer     *AciSigner
 	FabricName string
 }
 
 func (acs *AciClientSequential) Get(ctx context.Context, url string) ([]byte, int, error) {
-	req, err := http.NewRequest("GET", url, bytes.NewBuffer([]byte{}))
+	req, err := http.NewRequestWithContext(ctx, "GET", url, bytes.NewBuffer([]byte{}))
 	if err != nil {
 		log.WithFields(log.Fields{
 			LogFieldRequestID: ctx.Value(LogFieldRequestID),
@@ -79,23 +81,15 @@ func (acs *AciClientSequential) Get(ctx context.Context, url string) ([]byte, in
 		req.Header.Set(k, v)
 	}
 
-	cookie := http.Cookie{
-		Name:       HeaderAPICCookie,
-		Value:      acs.Token.token,
-		Path:       "",
-		Domain:     "",
-		Expires:    time.Time{},
-		RawExpires: "",
-		MaxAge:     0,
-		Secure:     false,
-		HttpOnly:   false,
-		SameSite:   0,
-		Raw:        "",
-		Unparsed:   nil,
+	err = addAuthentication(req, acs.Token, acs.Signer)
+	if err != nil {
+		log.WithFields(log.Fields{
+			LogFieldRequestID: ctx.Value(LogFieldRequestID),
+			LogFieldFabric:    fmt.Sprintf("%v", acs.FabricName),
+		}).Error(err)
+		return nil, 0, err
 	}
 
-	req.AddCookie(&cookie)
-
 	resp, err := acs.Client.Do(req)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -108,7 +102,7 @@ func (acs *AciClientSequential) Get(ctx context.Context, url string) ([]byte, in
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusOK {
-		bodyBytes, err := io.ReadAll(resp.Body)
+		bodyBytes, err := limitStateFromContext(ctx).readBody(resp.Body)
 		if err != nil {
 			log.WithFields(log.Fields{
 				LogFieldRequestID: ctx.Value(LogFieldRequestID),
@@ -119,7 +113,38 @@ func (acs *AciClientSequential) Get(ctx context.Context, url string) ([]byte, in
 
 		return bodyBytes, resp.StatusCode, nil
 	}
-	return nil, resp.StatusCode, fmt.Errorf(ACIApiReturnedStatusCode, resp.StatusCode)
+	return nil, resp.StatusCode, statusError(resp)
+}
+
+// statusError return the error of a response that is not 200. A response of 401, or 403 with the text "Token was
+// invalid", is an errInvalidToken since the token is no longer valid on the apic.
+func statusError(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return fmt.Errorf("%w - "+ACIApiReturnedStatusCode, errInvalidToken, resp.StatusCode)
+	case http.StatusForbidden:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if strings.Contains(string(body), "Token was invalid") {
+			return fmt.Errorf("%w - "+ACIApiReturnedStatusCode, errInvalidToken, resp.StatusCode)
+		}
+	}
+	return fmt.Errorf(ACIApiReturnedStatusCode, resp.StatusCode)
+}
+
+// addAuthentication add the APIC-cookie token to the request or, if certificate based authentication is used,
+// sign the request
+func addAuthentication(req *http.Request, token *AciToken, signer *AciSigner) error {
+	if signer != nil {
+		return signer.Sign(req, nil)
+	}
+	if token == nil {
+		return fmt.Errorf("no valid token")
+	}
+	req.AddCookie(&http.Cookie{
+		Name:  HeaderAPICCookie,
+		Value: token.token,
+	})
+	return nil
 }
 
 type ACIResponse struct {
@@ -131,6 +156,7 @@ type AciClientSequentialPage struct {
 	Client     http.Client
 	Headers    map[string]string
 	Token      *AciToken
+	Signer     *AciSigner
 	FabricName string
 	PageSize   int
 }
@@ -162,7 +188,13 @@ func (acsp *AciClientSequentialPage) Get(ctx context.Context, url string) ([]byt
 
 	numberOfPages := aciResponse.TotalCount / uint64(acsp.PageSize)
 
-	for ii := 1; ii < int(numberOfPages)+1; ii++ {
+	// The number of pages, including the first, may be limited by max_pages
+	pages, err := limitStateFromContext(ctx).pages(int(numberOfPages) + 1)
+	if err != nil {
+		return nil, status, err
+	}
+
+	for ii := 1; ii < pages; ii++ {
 		bodyBytes, status, err = acsp.getPage(ctx, url, pagedUrl, ii)
 		if err != nil {
 			return nil, status, err
@@ -184,7 +216,7 @@ func (acsp *AciClientSequentialPage) Get(ctx context.Context, url string) ([]byt
 }
 
 func (acsp *AciClientSequentialPage) getPage(ctx context.Context, url string, pagedUrl string, page int) ([]byte, int, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf(pagedUrl, url, acsp.PageSize, page), bytes.NewBuffer([]byte{}))
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf(pagedUrl, url, acsp.PageSize, page), bytes.NewBuffer([]byte{}))
 	if err != nil {
 		log.WithFields(log.Fields{
 			LogFieldRequestID: ctx.Value(LogFieldRequestID),
@@ -196,23 +228,15 @@ func (acsp *AciClientSequentialPage) getPage(ctx context.Context, url string, pa
 		req.Header.Set(k, v)
 	}
 
-	cookie := http.Cookie{
-		Name:       HeaderAPICCookie,
-		Value:      acsp.Token.token,
-		Path:       "",
-		Domain:     "",
-		Expires:    time.Time{},
-		RawExpires: "",
-		MaxAge:     0,
-		Secure:     false,
-		HttpOnly:   false,
-		SameSite:   0,
-		Raw:        "",
-		Unparsed:   nil,
+	err = addAuthentication(req, acsp.Token, acsp.Signer)
+	if err != nil {
+		log.WithFields(log.Fields{
+			LogFieldRequestID: ctx.Value(LogFieldRequestID),
+			LogFieldFabric:    fmt.Sprintf("%v", acsp.FabricName),
+		}).Error(err)
+		return nil, 0, err
 	}
 
-	req.AddCookie(&cookie)
-
 	resp, err := acsp.Client.Do(req)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -230,10 +254,10 @@ func (acsp *AciClientSequentialPage) getPage(ctx context.Context, url string, pa
 			LogFieldFabric:    fmt.Sprintf("%v", acsp.FabricName),
 			"status":          resp.StatusCode,
 		}).Error(ErrMsgInvalidStatusCode)
-		return nil, resp.StatusCode, fmt.Errorf(ACIApiReturnedStatusCode, resp.StatusCode)
+		return nil, resp.StatusCode, statusError(resp)
 	}
 
-	bodyBytes, err := io.ReadAll(resp.Body)
+	bodyBytes, err := limitStateFromContext(ctx).readBody(resp.Body)
 	if err != nil {
 		log.WithFields(log.Fields{
 			LogFieldRequestID: ctx.Value(LogFieldRequestID),
@@ -248,6 +272,7 @@ type AciClientParallelPage struct {
 	Client     http.Client
 	Headers    map[string]string
 	Token      *AciToken
+	Signer     *AciSigner
 	FabricName string
 	PageSize   int
 }
@@ -278,18 +303,44 @@ func (acpp *AciClientParallelPage) Get(ctx context.Context, url string) ([]byte,
 	_ = json.Unmarshal(bodyBytes, &aciResponse)
 
 	numberOfPages := aciResponse.TotalCount / uint64(acpp.PageSize)
-	ch := make(chan ACIResponse)
-	for ii := 1; ii < int(numberOfPages)+1; ii++ {
+
+	// The number of pages, including the first, may be limited by max_pages
+	pages, err := limitStateFromContext(ctx).pages(int(numberOfPages) + 1)
+	if err != nil {
+		return nil, status, err
+	}
+
+	ch := make(chan parallelPage)
+	for ii := 1; ii < pages; ii++ {
 		go acpp.getParallelPage(ctx, url, pagedUrl, ii, ch)
 		log.Info(fmt.Sprintf("Send page %d", ii))
 	}
-	for i := 1; i < int(numberOfPages)+1; i++ {
+	// All pages are received, also after a failed page, so no goroutine is blocked on the channel
+	var pageErr error
+	for i := 1; i < pages; i++ {
 		comm := <-ch
-		for _, imData := range comm.ImData {
+		if comm.err != nil {
+			if pageErr == nil {
+				pageErr = comm.err
+				status = comm.status
+			}
+			continue
+		}
+		for _, imData := range comm.response.ImData {
 			aciResponse.ImData = append(aciResponse.ImData, imData)
 		}
 		log.Info(fmt.Sprintf("Fetched page %d", i))
 	}
+	// A failed page is returned as the error of the request, so an invalid token is handled like for a single page
+	if pageErr != nil {
+		return nil, status, pageErr
+	}
+
+	// A page that exceeded max_response_bytes is not included, so the response is not complete
+	err = limitStateFromContext(ctx).responseBytesExceeded()
+	if err != nil {
+		return nil, status, err
+	}
 
 	data, _ := json.Marshal(aciResponse)
 
@@ -298,7 +349,7 @@ func (acpp *AciClientParallelPage) Get(ctx context.Context, url string) ([]byte,
 }
 
 func (acpp *AciClientParallelPage) getPage(ctx context.Context, url string, pagedUrl string, page int) ([]byte, int, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf(pagedUrl, url, acpp.PageSize, page), bytes.NewBuffer([]byte{}))
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf(pagedUrl, url, acpp.PageSize, page), bytes.NewBuffer([]byte{}))
 	if err != nil {
 		log.WithFields(log.Fields{
 			LogFieldRequestID: ctx.Value(LogFieldRequestID),
@@ -310,23 +361,15 @@ func (acpp *AciClientParallelPage) getPage(ctx context.Context, url string, page
 		req.Header.Set(k, v)
 	}
 
-	cookie := http.Cookie{
-		Name:       HeaderAPICCookie,
-		Value:      acpp.Token.token,
-		Path:       "",
-		Domain:     "",
-		Expires:    time.Time{},
-		RawExpires: "",
-		MaxAge:     0,
-		Secure:     false,
-		HttpOnly:   false,
-		SameSite:   0,
-		Raw:        "",
-		Unparsed:   nil,
+	err = addAuthentication(req, acpp.Token, acpp.Signer)
+	if err != nil {
+		log.WithFields(log.Fields{
+			LogFieldRequestID: ctx.Value(LogFieldRequestID),
+			LogFieldFabric:    fmt.Sprintf("%v", acpp.FabricName),
+		}).Error(err)
+		return nil, 0, err
 	}
 
-	req.AddCookie(&cookie)
-
 	resp, err := acpp.Client.Do(req)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -344,10 +387,10 @@ func (acpp *AciClientParallelPage) getPage(ctx context.Context, url string, page
 			LogFieldFabric:    fmt.Sprintf("%v", acpp.FabricName),
 			"status":          resp.StatusCode,
 		}).Error(ErrMsgInvalidStatusCode)
-		return nil, resp.StatusCode, fmt.Errorf(ACIApiReturnedStatusCode, resp.StatusCode)
+		return nil, resp.StatusCode, statusError(resp)
 	}
 
-	bodyBytes, err := io.ReadAll(resp.Body)
+	bodyBytes, err := limitStateFromContext(ctx).readBody(resp.Body)
 	if err != nil {
 		log.WithFields(log.Fields{
 			LogFieldRequestID: ctx.Value(LogFieldRequestID),
@@ -358,74 +401,22 @@ func (acpp *AciClientParallelPage) getPage(ctx context.Context, url string, page
 	return bodyBytes, resp.StatusCode, nil
 }
 
-func (acpp *AciClientParallelPage) getParallelPage(ctx context.Context, url string, pagedUrl string, page int, ch chan ACIResponse) {
+// parallelPage is the response, or the error, of a page fetched in parallel
+type parallelPage struct {
+	response ACIResponse
+	status   int
+	err      error
+}
+
+func (acpp *AciClientParallelPage) getParallelPage(ctx context.Context, url string, pagedUrl string, page int, ch chan parallelPage) {
 	aciResponse := ACIResponse{
 		TotalCount: 0,
 		ImData:     make([]map[string]interface{}, 0, acpp.PageSize),
 	}
 
-	req, err := http.NewRequest("GET", fmt.Sprintf(pagedUrl, url, acpp.PageSize, page), bytes.NewBuffer([]byte{}))
-	if err != nil {
-		log.WithFields(log.Fields{
-			LogFieldRequestID: ctx.Value(LogFieldRequestID),
-			LogFieldFabric:    fmt.Sprintf("%v", acpp.FabricName),
-		}).Error(err)
-		ch <- aciResponse
-		return
-	}
-	for k, v := range acpp.Headers {
-		req.Header.Set(k, v)
-	}
-
-	cookie := http.Cookie{
-		Name:       HeaderAPICCookie,
-		Value:      acpp.Token.token,
-		Path:       "",
-		Domain:     "",
-		Expires:    time.Time{},
-		RawExpires: "",
-		MaxAge:     0,
-		Secure:     false,
-		HttpOnly:   false,
-		SameSite:   0,
-		Raw:        "",
-		Unparsed:   nil,
-	}
-
-	req.AddCookie(&cookie)
-
-	resp, err := acpp.Client.Do(req)
-	if err != nil {
-		log.WithFields(log.Fields{
-			LogFieldRequestID: ctx.Value(LogFieldRequestID),
-			LogFieldFabric:    fmt.Sprintf("%v", acpp.FabricName),
-		}).Error(err)
-		ch <- aciResponse
-		return
-	}
-
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		log.WithFields(log.Fields{
-			LogFieldRequestID: ctx.Value(LogFieldRequestID),
-			LogFieldFabric:    fmt.Sprintf("%v", acpp.FabricName),
-			"status":          resp.StatusCode,
-		}).Error(ErrMsgInvalidStatusCode)
-		ch <- aciResponse
-		return
-	}
-
-	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.WithFields(log.Fields{
-			LogFieldRequestID: ctx.Value(LogFieldRequestID),
-			LogFieldFabric:    fmt.Sprintf("%v", acpp.FabricName),
-		}).Error(err)
-		ch <- aciResponse
-		return
+	bodyBytes, status, err := acpp.getPage(ctx, url, pagedUrl, page)
+	if err == nil {
+		_ = json.Unmarshal(bodyBytes, &aciResponse)
 	}
-	_ = json.Unmarshal(bodyBytes, &aciResponse)
-	ch <- aciResponse
-	return
+	ch <- parallelPage{response: aciResponse, status: status, err: err}
 }
@@ -0,0 +1,67 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestParallelPageInvalidToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"imdata":[{"error":{"attributes":{"text":"Token was invalid (Error: Token timeout)"}}}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"totalCount":"5","imdata":[{"fvTenant":{"attributes":{"name":"t"}}},` +
+			`{"fvTenant":{"attributes":{"name":"t"}}}]}`))
+	}))
+	t.Cleanup(server.Close)
+
+	client := &AciClientParallelPage{
+		Client:     *server.Client(),
+		Token:      &AciToken{token: "token"},
+		FabricName: "paged",
+		PageSize:   2,
+	}
+	_, status, err := client.Get(context.Background(), server.URL+"/api/class/fvTenant.json")
+	if !errors.Is(err, errInvalidToken) {
+		t.Fatalf("expected invalid token error of the failed page, got %v", err)
+	}
+	if status != http.StatusForbidden {
+		t.Errorf("expected status 403 of the failed page, got %d", status)
+	}
+}
+
+func TestInvalidTLSFailRequests(t *testing.T) {
+	SetDefaultValues()
+	t.Cleanup(func() {
+		removeConnections("invalid-tls")
+		viper.Reset()
+	})
+
+	// A fabric that is not loaded from the configuration, like of the cli, is not validated
+	con := newAciConnection(&Fabric{FabricName: "invalid-tls", Username: "admin", Password: "pw",
+		Apic: []string{"https://127.0.0.1:1"}, TLS: FabricTLS{CAFile: filepath.Join(t.TempDir(), "missing.pem")}}, nil)
+	_, err := con.Client.Get("https://127.0.0.1:1/api/class/fvTenant.json")
+	if err == nil || !strings.Contains(err.Error(), "missing.pem") {
+		t.Fatalf("expected requests to fail with the tls error, got %v", err)
+	}
+}
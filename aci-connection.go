@@ -14,11 +14,14 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tidwall/gjson"
@@ -46,6 +49,16 @@ var refreshMetric = promauto.NewCounterVec(prometheus.CounterOpts{
 	[]string{"fabric"},
 )
 
+var reloginMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: MetricsPrefix + "auth_relogin",
+	Help: "Number of forced logins since the token was not valid on the apic",
+},
+	[]string{"fabric"},
+)
+
+// errInvalidToken is returned if the apic do not accept the token, e.g. after a reboot of the apic
+var errInvalidToken = errors.New("token was invalid")
+
 var refreshFailedMetric = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: MetricsPrefix + "auth_refresh_failed",
 	Help: "Authentication refresh failed counter",
@@ -62,18 +75,29 @@ type AciToken struct {
 
 // AciConnection is the connection object
 type AciConnection struct {
-	fabricConfig     *Fabric
-	activeController *int
+	fabricConfig *Fabric
+	// activeController is the index of the apic controller used, and controllerDown the controllers that failed
+	activeController int
+	controllerDown   map[int]bool
+	controllerMutex  sync.Mutex
 	URLMap           map[string]string
 	Headers          map[string]string
 	Client           http.Client
-	token            *AciToken
-	tokenMutex       sync.Mutex
+	// token is read without the token mutex by the requests, and only changed with the token mutex locked
+	token      atomic.Pointer[AciToken]
+	tokenMutex sync.Mutex
+	// If certificate based authentication is used every request is signed and no token is used
+	signer *AciSigner
 	// If a node query this is set to the instance
 	Node *string
+	// If the connection is used for subscriptions they are refreshed with the token
+	subscriber *Subscriber
+	// lastUsed is the unix time the connection was last used, idle node connections are evicted from the cache
+	lastUsed atomic.Int64
 }
 
 var connectionCache = make(map[string]*AciConnection)
+var connectionCacheMutex sync.Mutex
 
 // cacheName returns a unique name for the connection. Every connection is unique per fabric and node with own
 // cache entry
@@ -85,18 +109,27 @@ func cacheName(aciName string, node *string) string {
 }
 
 func newAciConnection(fabricConfig *Fabric, node *string) *AciConnection {
+	connectionCacheMutex.Lock()
+	defer connectionCacheMutex.Unlock()
+
 	// Check if we have a connection in the cache
 	val, ok := connectionCache[cacheName(fabricConfig.FabricName, node)]
 	if ok {
+		val.touch()
 		return val
 	}
 
-	var httpClient = HTTPClient{
-		InsecureHTTPS:       viper.GetBool("httpclient.insecureHTTPS"),
-		Timeout:             viper.GetInt("httpclient.timeout"),
-		Keepalive:           viper.GetInt("httpclient.keepalive"),
-		Tlshandshaketimeout: viper.GetInt("httpclient.tlshandshaketimeout"),
-	}.GetClient()
+	httpClient, err := fabricConfig.httpClient(node)
+	if err != nil {
+		// Only a fabric that is not loaded from the configuration can have invalid settings, all requests fail
+		log.WithFields(log.Fields{
+			LogFieldFabric: fabricConfig.FabricName,
+		}).Error("http client settings not valid - ", err)
+		httpClient = http.Client{Transport: errorTransport{err: err}}
+	}
+	// The apic controllers of the fabric and every node have their own limit of concurrent requests
+	httpClient.Transport = newRequestLimiter(httpClient.Transport, fabricConfig.maxInflightRequests(),
+		fabricConfig.FabricName)
 
 	var headers = make(map[string]string)
 	headers["Content-Type"] = "application/json"
@@ -109,20 +142,71 @@ func newAciConnection(fabricConfig *Fabric, node *string) *AciConnection {
 	urlMap["faults"] = "/api/class/faultCountsWithDetails.json"
 
 	con := &AciConnection{
-		fabricConfig:     fabricConfig,
-		activeController: new(int),
-		URLMap:           urlMap,
-		Headers:          headers,
-		Client:           *httpClient,
-		Node:             node,
+		fabricConfig: fabricConfig,
+		URLMap:       urlMap,
+		Headers:      headers,
+		Client:       httpClient,
+		Node:         node,
 	}
+	con.touch()
 	connectionCache[cacheName(fabricConfig.FabricName, node)] = con
+	updateSessionsMetric()
 	return connectionCache[cacheName(fabricConfig.FabricName, node)]
 }
 
+// errorTransport fail all requests with the error
+type errorTransport struct {
+	err error
+}
+
+func (t errorTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, t.err
+}
+
+// newFabricHTTPClient create the http client with the tls and proxy settings of the fabric. The server name is only
+// used for the apic, since every node has its own name.
+func newFabricHTTPClient(fabricConfig *Fabric, node *string) (*http.Client, error) {
+	fabricTLS := fabricConfig.TLS
+	if node != nil {
+		fabricTLS.ServerName = ""
+	}
+	return HTTPClient{
+		InsecureHTTPS:       viper.GetBool("httpclient.insecureHTTPS"),
+		Timeout:             viper.GetInt("httpclient.timeout"),
+		Keepalive:           viper.GetInt("httpclient.keepalive"),
+		Tlshandshaketimeout: viper.GetInt("httpclient.tlshandshaketimeout"),
+		TLS:                 fabricTLS,
+		ProxyURL:            fabricConfig.ProxyURL,
+	}.GetClient()
+}
+
+// removeConnections remove all cached connections, including node connections, of the fabric. The sessions of the
+// removed connections are logged out in the background.
+func removeConnections(fabricName string) {
+	connectionCacheMutex.Lock()
+	defer connectionCacheMutex.Unlock()
+
+	var removed []*AciConnection
+	for name, con := range connectionCache {
+		if con.fabricConfig.FabricName == fabricName {
+			if con.Node == nil {
+				removeControllerStates(con.fabricConfig)
+			}
+			delete(connectionCache, name)
+			removed = append(removed, con)
+		}
+	}
+	updateSessionsMetric()
+	go logoutConnections(removed)
+}
+
 // login get the existing token if valid or do a full /login
 func (c *AciConnection) login(ctx context.Context) error {
 
+	if c.fabricConfig.PrivateKeyFile != "" {
+		return c.signatureLogin(ctx)
+	}
+
 	err, done := c.tokenProcessing(ctx)
 	if done {
 		return err
@@ -142,14 +226,47 @@ func (c *AciConnection) loginProcessing(ctx context.Context) error {
 	}
 }
 
+// signatureLogin load the private key used to sign all requests, no /login is done
+func (c *AciConnection) signatureLogin(ctx context.Context) error {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+	if c.signer != nil {
+		return nil
+	}
+
+	signer, err := newAciSigner(c.fabricConfig.PrivateKeyFile, c.fabricConfig.CertificateDN)
+	if err != nil {
+		log.WithFields(log.Fields{
+			LogFieldRequestID: ctx.Value(LogFieldRequestID),
+			LogFieldFabric:    fmt.Sprintf("%v", c.fabricConfig.FabricName),
+			"token":           "signature",
+		}).Error(err)
+		return err
+	}
+	c.signer = signer
+
+	log.WithFields(log.Fields{
+		LogFieldRequestID: ctx.Value(LogFieldRequestID),
+		LogFieldFabric:    fmt.Sprintf("%v", c.fabricConfig.FabricName),
+		"token":           "signature",
+		"certificate_dn":  c.fabricConfig.CertificateDN,
+	}).Info("Using certificate based authentication")
+	return nil
+}
+
 func (c *AciConnection) apicLogin(ctx context.Context) error {
+	username, password, err := c.credentials(ctx)
+	if err != nil {
+		return err
+	}
+
 	for i, controller := range c.fabricConfig.Apic {
 
-		response, status, err := c.doPostJSON(ctx, "login", fmt.Sprintf("%s%s", controller, c.URLMap["login"]),
-			[]byte(fmt.Sprintf("{\"aaaUser\":{\"attributes\":{\"name\":\"%s\",\"pwd\":\"%s\"}}}", c.fabricConfig.Username, c.fabricConfig.Password)))
+		response, status, err := c.doPostJSON(ctx, "login", fmt.Sprintf("%s%s", controller, c.URLMap["login"]), nil,
+			aaaUserBody(username, password))
 
 		if err != nil || status != 200 {
-
+			c.setControllerState(i, false)
 			err = fmt.Errorf("failed to login to %s, try next apic", controller)
 
 			log.WithFields(log.Fields{
@@ -161,7 +278,7 @@ func (c *AciConnection) apicLogin(ctx context.Context) error {
 		} else {
 			c.newToken(response)
 
-			*c.activeController = i
+			c.setController(i)
 			log.WithFields(log.Fields{
 				LogFieldRequestID: ctx.Value(LogFieldRequestID),
 				LogFieldFabric:    fmt.Sprintf("%v", c.fabricConfig.FabricName),
@@ -171,13 +288,47 @@ func (c *AciConnection) apicLogin(ctx context.Context) error {
 			return nil
 		}
 	}
+	// The cached secrets may be rotated, read them again on next login
+	clearSecretCache()
 	return fmt.Errorf("failed to login to any apic controllers")
 }
 
+// aaaUserBody return the body of a login, or a logout if the password is empty. The body is encoded since the
+// credentials may include characters that must be escaped in json.
+func aaaUserBody(username string, password string) []byte {
+	type attributes struct {
+		Name string `json:"name"`
+		Pwd  string `json:"pwd,omitempty"`
+	}
+	type aaaUser struct {
+		Attributes attributes `json:"attributes"`
+	}
+	body, _ := json.Marshal(map[string]aaaUser{"aaaUser": {Attributes: attributes{Name: username, Pwd: password}}})
+	return body
+}
+
+// credentials return the username and password of the fabric
+func (c *AciConnection) credentials(ctx context.Context) (string, string, error) {
+	username, password, err := c.fabricConfig.credentials(ctx)
+	if err != nil {
+		log.WithFields(log.Fields{
+			LogFieldRequestID: ctx.Value(LogFieldRequestID),
+			LogFieldFabric:    fmt.Sprintf("%v", c.fabricConfig.FabricName),
+			"token":           "login",
+		}).Error("credentials not available - ", err)
+	}
+	return username, password, err
+}
+
 func (c *AciConnection) nodeLogin(ctx context.Context) error {
+	username, password, err := c.credentials(ctx)
+	if err != nil {
+		return err
+	}
+
 	// Node query
-	response, status, err := c.doPostJSON(ctx, "login", fmt.Sprintf("%s%s", *c.Node, c.URLMap["login"]),
-		[]byte(fmt.Sprintf("{\"aaaUser\":{\"attributes\":{\"name\":\"%s\",\"pwd\":\"%s\"}}}", c.fabricConfig.Username, c.fabricConfig.Password)))
+	response, status, err := c.doPostJSON(ctx, "login", fmt.Sprintf("%s%s", *c.Node, c.URLMap["login"]), nil,
+		aaaUserBody(username, password))
 
 	if err != nil || status != 200 {
 		err = fmt.Errorf("failed to login to %s", *c.Node)
@@ -187,6 +338,7 @@ func (c *AciConnection) nodeLogin(ctx context.Context) error {
 			"token":           fmt.Sprintf("login"),
 			"node":            *c.Node,
 		}).Error(err)
+		clearSecretCache()
 		return fmt.Errorf("failed to login to node")
 	}
 
@@ -200,20 +352,35 @@ func (c *AciConnection) nodeLogin(ctx context.Context) error {
 	return nil
 }
 
-// tokenProcessing if token are valid reuse or try to do a /refresh
+// tokenProcessing if token are valid reuse or try to do a /refresh. The subscriptions are refreshed after the token
+// mutex is unlocked.
 func (c *AciConnection) tokenProcessing(ctx context.Context) (error, bool) {
-	if c.token != nil {
+	err, done := c.validToken(ctx)
+	if err == nil && done {
+		c.refreshSubscriptions(ctx)
+	}
+	return err, done
+}
+
+// validToken reuse the token if valid or try to do a /refresh, false if a /login is needed
+func (c *AciConnection) validToken(ctx context.Context) (error, bool) {
+	if c.token.Load() != nil {
 		c.tokenMutex.Lock()
 		defer c.tokenMutex.Unlock()
-		if c.token.lifetime < time.Now().Unix() {
+		token := c.token.Load()
+		if token == nil {
+			// The token was invalidated by another request
+			return nil, false
+		}
+		if token.lifetime < time.Now().Unix() {
 			log.WithFields(log.Fields{
 				LogFieldRequestID: ctx.Value(LogFieldRequestID),
 				LogFieldFabric:    fmt.Sprintf("%v", c.fabricConfig.FabricName),
 				"token":           fmt.Sprintf("lifetime"),
 			}).Info("token reached lifetime seconds")
 			return nil, false
-		} else if c.token.expire < time.Now().Unix() {
-			response, status, err := c.get(ctx, "refresh", fmt.Sprintf("%s%s", c.fabricConfig.Apic[*c.activeController], c.URLMap["refresh"]))
+		} else if token.expire < time.Now().Unix() {
+			response, status, err := c.get(ctx, "refresh", fmt.Sprintf("%s%s", c.controller(), c.URLMap["refresh"]))
 			if err != nil || status != 200 {
 				log.WithFields(log.Fields{
 					LogFieldRequestID: ctx.Value(LogFieldRequestID),
@@ -239,7 +406,7 @@ func (c *AciConnection) tokenProcessing(ctx context.Context) (error, bool) {
 				LogFieldRequestID:    ctx.Value(LogFieldRequestID),
 				LogFieldFabric:       fmt.Sprintf("%v", c.fabricConfig.FabricName),
 				"token":              fmt.Sprintf("valid"),
-				"valid_time_seconds": c.token.expire - time.Now().Unix()}).Debug("token still valid")
+				"valid_time_seconds": token.expire - time.Now().Unix()}).Debug("token still valid")
 			return nil, true
 		}
 	}
@@ -252,28 +419,58 @@ func (c *AciConnection) newToken(response []byte) {
 	ttl := gjson.Get(string(response), "imdata.0.aaaLogin.attributes.refreshTimeoutSeconds").Int()
 	lifetimeSeconds := gjson.Get(string(response), "imdata.0.aaaLogin.attributes.maximumLifetimeSeconds").Int()
 	now := time.Now().Unix()
-	c.token = &AciToken{
+	c.token.Store(&AciToken{
 		token:    token,
 		ttl:      ttl,
 		expire:   now + ttl - TTLOffset,
 		lifetime: now + lifetimeSeconds - TTLOffset,
-	}
+	})
 }
 
 func (c *AciConnection) refreshToken(response []byte) {
 	token := gjson.Get(string(response), "imdata.0.aaaLogin.attributes.token").String()
 	ttl := gjson.Get(string(response), "imdata.0.aaaLogin.attributes.refreshTimeoutSeconds").Int()
 
-	c.token = &AciToken{
+	c.token.Store(&AciToken{
 		token:    token,
 		ttl:      ttl,
 		expire:   time.Now().Unix() + ttl - TTLOffset,
-		lifetime: c.token.lifetime,
+		lifetime: c.token.Load().lifetime,
+	})
+}
+
+// reloginAllowed is false for certificate based authentication, that has no token, for the token refresh that is done
+// with the token mutex locked, and for the subscription refresh since a new login require a new websocket
+func (c *AciConnection) reloginAllowed(label string) bool {
+	return c.fabricConfig.PrivateKeyFile == "" && label != "refresh" && label != "subscriptionRefresh"
+}
+
+// relogin invalidate the token and do a new login. If the token has already been replaced by another request, that
+// got the same invalid token, no login is done.
+func (c *AciConnection) relogin(ctx context.Context, invalid *AciToken) error {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+	if c.token.Load() != invalid {
+		return nil
 	}
+
+	log.WithFields(log.Fields{
+		LogFieldRequestID: ctx.Value(LogFieldRequestID),
+		LogFieldFabric:    fmt.Sprintf("%v", c.fabricConfig.FabricName),
+		"token":           "relogin",
+	}).Warning("token was invalid, login again")
+	reloginMetric.With(prometheus.Labels{LogFieldFabric: fmt.Sprintf("%v", c.fabricConfig.FabricName)}).Inc()
+
+	// If the login fail the next request do a full login
+	c.token.Store(nil)
+	if c.Node != nil {
+		return c.nodeLogin(ctx)
+	}
+	return c.apicLogin(ctx)
 }
 
 func (c *AciConnection) GetByQuery(ctx context.Context, table string) (string, error) {
-	data, _, err := c.get(ctx, table, fmt.Sprintf("%s%s", c.fabricConfig.Apic[*c.activeController], c.URLMap[table]))
+	data, _, err := c.get(ctx, table, fmt.Sprintf("%s%s", c.controller(), c.URLMap[table]))
 	if err != nil {
 		log.WithFields(log.Fields{
 			LogFieldRequestID: ctx.Value(LogFieldRequestID),
@@ -287,7 +484,7 @@ func (c *AciConnection) GetByQuery(ctx context.Context, table string) (string, e
 func (c *AciConnection) GetByClassQuery(ctx context.Context, class string, query string) (string, error) {
 	if c.Node == nil {
 		// A apic query
-		data, _, err := c.get(ctx, class, fmt.Sprintf("%s/api/class/%s.json%s", c.fabricConfig.Apic[*c.activeController], class, query))
+		data, _, err := c.get(ctx, class, fmt.Sprintf("%s/api/class/%s.json%s", c.controller(), class, query))
 		if err != nil {
 			log.WithFields(log.Fields{
 				LogFieldRequestID: ctx.Value(LogFieldRequestID),
@@ -311,11 +508,71 @@ func (c *AciConnection) GetByClassQuery(ctx context.Context, class string, query
 	}
 }
 
+// get do the GET request. A request that fail by a connection error, 5xx or 429 is retried with backoff, and a
+// request to an apic controller that fail by a connection error or 5xx is retried on the next apic controller. If
+// the token is not valid on the apic a new login is done and the request is replayed once. A request cancelled by the
+// context is not retried.
 func (c *AciConnection) get(ctx context.Context, label string, url string) ([]byte, int, error) {
+	retries := viper.GetInt("httpclient.retries")
+	if label == "refresh" {
+		// The token refresh is done with the token mutex locked, a failed refresh is followed by a login instead
+		retries = 0
+	}
+
+	var body []byte
+	var status int
+	var err error
+	relogin := false
+	for attempt := 0; ; attempt++ {
+		c.touch()
+		token := c.token.Load()
+		body, status, err = c.getOnce(ctx, label, url, token)
+		if !relogin && c.reloginAllowed(label) && errors.Is(err, errInvalidToken) {
+			relogin = true
+			if c.relogin(ctx, token) == nil {
+				body, status, err = c.getOnce(ctx, label, url, c.token.Load())
+			}
+		}
+		if ctx.Err() != nil {
+			// The request was cancelled, not failed by the controller
+			break
+		}
+		c.updateControllerState(url, status, err)
+		if attempt >= retries || !retryable(status, err) {
+			break
+		}
+
+		if controllerFailed(status, err) {
+			url = c.failover(ctx, url)
+		}
+		backoff := retryBackoff(attempt)
+		retryMetric.With(prometheus.Labels{LogFieldFabric: c.fabricConfig.FabricName}).Inc()
+		log.WithFields(log.Fields{
+			LogFieldRequestID: ctx.Value(LogFieldRequestID),
+			LogFieldFabric:    fmt.Sprintf("%v", c.fabricConfig.FabricName),
+			"class":           label,
+			"status":          status,
+			"attempt":         attempt + 1,
+		}).Warning(fmt.Sprintf("request failed, retry in %s - %s", backoff, err))
+		if !sleepContext(ctx, backoff) {
+			break
+		}
+	}
+
+	// The token and subscription refresh are not recorded since the fake apic always accept refresh. A request without
+	// a response, like a connection error, or a response that could not be read is not recorded.
+	recordable := status > 0 && (err == nil || status != http.StatusOK)
+	if recorder != nil && recordable && label != "refresh" && label != "subscriptionRefresh" {
+		recorder.record(c.fabricConfig.FabricName, c.Node, url, status, body)
+	}
+	return body, status, err
+}
+
+// getOnce do a single GET request, with all pages if paged
+func (c *AciConnection) getOnce(ctx context.Context, label string, url string, token *AciToken) ([]byte, int, error) {
 	start := time.Now()
-	//body, status, err := c.doGet(ctx, url)
 
-	aciClient := NewAciClient(c.Client, c.Headers, c.token, c.fabricConfig.FabricName, url)
+	aciClient := NewAciClient(c.Client, c.Headers, token, c.signer, c.fabricConfig.FabricName, url)
 
 	body, status, err := aciClient.Get(ctx, url)
 
@@ -341,7 +598,7 @@ func (c *AciConnection) get(ctx context.Context, label string, url string) ([]by
 
 func (c *AciConnection) doGet(ctx context.Context, url string) ([]byte, int, error) {
 
-	req, err := http.NewRequest("GET", url, bytes.NewBuffer([]byte{}))
+	req, err := http.NewRequestWithContext(ctx, "GET", url, bytes.NewBuffer([]byte{}))
 	if err != nil {
 		log.WithFields(log.Fields{
 			LogFieldRequestID: ctx.Value(LogFieldRequestID),
@@ -355,7 +612,7 @@ func (c *AciConnection) doGet(ctx context.Context, url string) ([]byte, int, err
 
 	cookie := http.Cookie{
 		Name:       "APIC-cookie",
-		Value:      c.token.token,
+		Value:      c.token.Load().token,
 		Path:       "",
 		Domain:     "",
 		Expires:    time.Time{},
@@ -396,9 +653,11 @@ func (c *AciConnection) doGet(ctx context.Context, url string) ([]byte, int, err
 	return nil, resp.StatusCode, fmt.Errorf("ACI api returned %d", resp.StatusCode)
 }
 
-func (c *AciConnection) doPostJSON(ctx context.Context, label string, url string, requestBody []byte) ([]byte, int, error) {
+// doPostJSON post the request, the token is only set for requests that need a session like the logout
+func (c *AciConnection) doPostJSON(ctx context.Context, label string, url string, token *AciToken,
+	requestBody []byte) ([]byte, int, error) {
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(requestBody))
 	if err != nil {
 		log.WithFields(log.Fields{
 			LogFieldRequestID: ctx.Value(LogFieldRequestID),
@@ -411,6 +670,12 @@ func (c *AciConnection) doPostJSON(ctx context.Context, label string, url string
 		req.Header.Set(k, v)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	if token != nil {
+		req.AddCookie(&http.Cookie{
+			Name:  HeaderAPICCookie,
+			Value: token.token,
+		})
+	}
 
 	start := time.Now()
 	resp, err := c.Client.Do(req)
@@ -22,6 +22,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/yaml.v2"
@@ -78,7 +79,6 @@ func isFlagPassed(name string) bool {
 }
 
 var version = "undefined"
-var querySet = mapset.NewSet[string]()
 
 func main() {
 
@@ -104,6 +104,10 @@ func main() {
 	query := flag.String("query", viper.GetString("query"), "The query for the class - only cli")
 	fabric := flag.String("fabric", viper.GetString("fabric"), "The fabric name - only cli")
 	versionFlag := flag.Bool("v", false, "Show version")
+	validate := flag.Bool("validate", false, "Validate the queries of the configuration and exit")
+	fakeApic := flag.String("fake_apic", "", "Run a fake apic that serve the recorded responses in the directory, the directory of a single fabric or node")
+	fakeApicPort := flag.Int("fake_apic_port", 9644, "The port of the fake apic - only fake_apic")
+	validateData := flag.String("validate_data", "", "Directory with saved class query responses, named <class_name>.json, to dry run the class and group queries against - only validate")
 
 	// configuration directory is always relative to the directory where the config file is located
 	configDirName := flag.String("config_dir", viper.GetString("config_dir"), "The configuration directory, default config.d")
@@ -160,11 +164,21 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *fakeApic != "" {
+		err := runFakeApic(*fakeApic, ":"+strconv.Itoa(*fakeApicPort))
+		log.Error("Fake apic failed - ", err)
+		os.Exit(1)
+	}
+
 	if *writeConfig {
 		var queries = AllQueries{}
 		_, err := os.Stat(*configDirName)
 		if err == nil {
-			readConfigDirectory(configDirName, ".", &queries)
+			err = readConfigDirectory(configDirName, ".", &queries)
+			if err != nil {
+				log.Error("Unable to read the configuration directory - ", err)
+				os.Exit(1)
+			}
 			viper.Set("class_queries", queries.ClassQueries)
 			viper.Set("group_class_queries", queries.GroupClassQueries)
 			viper.Set("compound_queries", queries.CompoundClassQueries)
@@ -220,82 +234,86 @@ func main() {
 	}
 
 	// Read all config from config file and directory
-	var queries = AllQueries{}
-
-	readConfigDirectory(configDirName, filepath.Dir(viper.ConfigFileUsed()), &queries)
-
-	// check for configurations in the main configuration file
-
-	err = viper.UnmarshalKey("class_queries", &queries.ClassQueries)
+	allQueries, err := loadQueries(viper.GetViper(), configDirName)
 	if err != nil {
-		log.Error("Unable to decode class_queries into struct - ", err)
+		log.Error("Unable to load queries - ", err)
 		os.Exit(1)
 	}
 
-	err = viper.UnmarshalKey("compound_queries", &queries.CompoundClassQueries)
-	if err != nil {
-		log.Error("Unable to decode compound_queries into struct - ", err)
-		os.Exit(1)
+	if *validate {
+		os.Exit(validateConfiguration(allQueries, *validateData))
 	}
 
-	err = viper.UnmarshalKey("qroup_class_queries", &queries.GroupClassQueries)
+	allFabrics, err := loadFabrics(viper.GetViper())
 	if err != nil {
-		log.Error("Unable to decode qroup_class_queries into struct - ", err)
+		log.Error("Unable to load fabrics - ", err)
 		os.Exit(1)
 	}
 
-	allQueries := AllQueries{
-		ClassQueries:         queries.ClassQueries,
-		CompoundClassQueries: queries.CompoundClassQueries,
-		GroupClassQueries:    queries.GroupClassQueries,
+	for fabricName := range allFabrics {
+		log.WithFields(log.Fields{
+			LogFieldFabric: fabricName,
+		}).Info("Configured fabric")
 	}
 
-	// Create a set of all query names - used to validate the query parameter
-	createQueryNameSet(allQueries)
+	if viper.GetString("recording.directory") != "" {
+		recorder, err = NewRecorder(viper.GetString("recording.directory"))
+		if err != nil {
+			log.Error("Unable to create recording directory - ", err)
+			os.Exit(1)
+		}
+		log.WithFields(log.Fields{
+			"directory": viper.GetString("recording.directory"),
+		}).Warning("recording of all apic responses enabled")
+	}
 
-	// Init all fabrics
-	allFabrics := make(map[string]*Fabric)
+	// The set of all query names is used to validate the query parameter
+	handler := NewHandlerInit(allQueries, allFabrics)
 
-	err = viper.UnmarshalKey("fabrics", &allFabrics)
-	if err != nil {
-		log.Error("Unable to decode fabrics into struct - ", err)
-		os.Exit(1)
+	// The configuration read at start is the first successful load
+	configReloadSuccessMetric.Set(1)
+	configReloadSuccessTimestampMetric.SetToCurrentTime()
+
+	if viper.GetBool("background_collection.enabled") {
+		handler.scheduler = NewScheduler(handler,
+			viper.GetDuration("background_collection.interval")*time.Second,
+			viper.GetDuration("background_collection.idle_timeout")*time.Second)
+		log.WithFields(log.Fields{
+			"interval":     viper.GetInt("background_collection.interval"),
+			"idle_timeout": viper.GetInt("background_collection.idle_timeout"),
+		}).Info("background collection enabled")
 	}
 
-	// Init discovery settings
-	for fabricName := range allFabrics {
-		if allFabrics[fabricName].DiscoveryConfig.TargetFields == nil {
-			allFabrics[fabricName].DiscoveryConfig.TargetFields = viper.GetStringSlice("service_discovery.target_fields")
-		}
-		if allFabrics[fabricName].DiscoveryConfig.LabelsKeys == nil {
-			allFabrics[fabricName].DiscoveryConfig.LabelsKeys = viper.GetStringSlice("service_discovery.labels")
-		}
-		if allFabrics[fabricName].DiscoveryConfig.TargetFormat == "" {
-			allFabrics[fabricName].DiscoveryConfig.TargetFormat = viper.GetString("service_discovery.target_format")
+	// Reload queries and fabrics on SIGHUP, started after the scheduler is set since a reload stop its collections
+	go handler.reloadOnSignal(configDirName)
+
+	if viper.GetBool("otlp.enabled") {
+		otlpExporter, err := NewOTLPExporter(handler)
+		if err != nil {
+			log.Error("Unable to create otlp exporter - ", err)
+			os.Exit(1)
 		}
-	}
-	// Overwrite username or password for APIC by environment variables if set
-	for fabricName := range allFabrics {
-		fabricEnv(fabricName, allFabrics)
+		otlpExporter.Start()
 	}
 
-	for fabricName, fabric := range allFabrics {
-		fabric.FabricName = fabricName
+	if viper.GetBool("subscriptions.enabled") {
+		StartSubscriptions(handler)
 	}
 
-	if val, exists := os.LookupEnv(fmt.Sprintf("%s_FABRIC_NAMES", ExporterNameAsEnv())); exists == true && val != "" {
-		for _, fabricName := range strings.Split(val, ",") {
-			fabricEnv(fabricName, allFabrics)
-		}
+	if viper.GetBool("node_cache.enabled") {
+		StartNodeCache(handler)
 	}
 
-	for fabricName := range allFabrics {
-		log.WithFields(log.Fields{
-			LogFieldFabric: fabricName,
-		}).Info("Configured fabric")
-	}
+	StartConnectionEviction(handler)
 
-	handler := &HandlerInit{allQueries, allFabrics}
+	if viper.GetBool("event_streaming.enabled") {
+		eventStreamer, err := NewEventStreamer(handler)
+		if err != nil {
+			log.Error("Unable to create event streaming - ", err)
+			os.Exit(1)
+		}
+		eventStreamer.Start()
+	}
 
 	// Create a Prometheus histogram for response time of the exporter
 	responseTime := promauto.NewHistogramVec(prometheus.HistogramOpts{
@@ -311,6 +329,11 @@ func main() {
 	http.Handle("/alive", logCall(promMonitor(http.HandlerFunc(alive), responseTime, "/alive")))
 	http.Handle("/sd", logCall(promMonitor(http.HandlerFunc(handler.discovery), responseTime, "/sd")))
 
+	// The reload endpoint is only enabled if a token is configured
+	if viper.GetString("reload.token") != "" {
+		http.Handle("/-/reload", logCall(promMonitor(handler.reloadHandler(configDirName), responseTime, "/-/reload")))
+	}
+
 	// Setup handler for exporter metrics
 	http.Handle("/metrics", promhttp.HandlerFor(
 		prometheus.DefaultGatherer,
@@ -343,10 +366,20 @@ func main() {
 		"read_timeout":  viper.GetDuration("httpserver.read_timeout") * time.Second,
 		"write_timeout": viper.GetDuration("httpserver.write_timeout") * time.Second,
 	}).Info("aci-exporter starting")
-	log.Fatal(s.ListenAndServe())
+
+	stopped := make(chan struct{})
+	go handler.shutdownOnSignal(s, stopped)
+
+	err = s.ListenAndServe()
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+	log.Info("aci-exporter stopped")
 }
 
-func createQueryNameSet(allQueries AllQueries) {
+func createQueryNameSet(allQueries AllQueries) mapset.Set[string] {
+	querySet := mapset.NewSet[string]()
 	for queryName, _ := range allQueries.ClassQueries {
 		querySet.Add(queryName)
 	}
@@ -357,39 +390,143 @@ func createQueryNameSet(allQueries AllQueries) {
 		querySet.Add(queryName)
 	}
 	querySet.Add("faults")
+	querySet.Add("fault_instances")
+	return querySet
 }
 
-func readConfigDirectory(configDirName *string, dirPath string, queries *AllQueries) {
+// loadQueries read all queries from the configuration directory and the configuration file of the viper instance
+func loadQueries(v *viper.Viper, configDirName *string) (AllQueries, error) {
+	var queries = AllQueries{}
+
+	err := readConfigDirectory(configDirName, filepath.Dir(v.ConfigFileUsed()), &queries)
+	if err != nil {
+		return AllQueries{}, err
+	}
+
+	// check for configurations in the main configuration file
+
+	err = v.UnmarshalKey("class_queries", &queries.ClassQueries)
+	if err != nil {
+		return AllQueries{}, fmt.Errorf("unable to decode class_queries into struct - %s", err)
+	}
+
+	err = v.UnmarshalKey("compound_queries", &queries.CompoundClassQueries)
+	if err != nil {
+		return AllQueries{}, fmt.Errorf("unable to decode compound_queries into struct - %s", err)
+	}
+
+	err = v.UnmarshalKey("qroup_class_queries", &queries.GroupClassQueries)
+	if err != nil {
+		return AllQueries{}, fmt.Errorf("unable to decode qroup_class_queries into struct - %s", err)
+	}
+
+	err = v.UnmarshalKey("relabel_configs", &queries.RelabelConfigs)
+	if err != nil {
+		return AllQueries{}, fmt.Errorf("unable to decode relabel_configs into struct - %s", err)
+	}
+
+	allQueries := AllQueries{
+		ClassQueries:         queries.ClassQueries,
+		CompoundClassQueries: queries.CompoundClassQueries,
+		GroupClassQueries:    queries.GroupClassQueries,
+		RelabelConfigs:       queries.RelabelConfigs,
+	}
+	err = allQueries.compileRelabelConfigs()
+	if err != nil {
+		return AllQueries{}, err
+	}
+	err = allQueries.checkAggregations()
+	if err != nil {
+		return AllQueries{}, err
+	}
+	return allQueries, nil
+}
+
+// loadFabrics read all fabrics from the configuration file of the viper instance, with defaults and environment
+// variables applied
+func loadFabrics(v *viper.Viper) (map[string]*Fabric, error) {
+	allFabrics := make(map[string]*Fabric)
+
+	err := v.UnmarshalKey("fabrics", &allFabrics)
+	if err != nil {
+		return nil, err
+	}
+
+	// Init discovery settings
+	for fabricName := range allFabrics {
+		if allFabrics[fabricName].DiscoveryConfig.TargetFields == nil {
+			allFabrics[fabricName].DiscoveryConfig.TargetFields = v.GetStringSlice("service_discovery.target_fields")
+		}
+		if allFabrics[fabricName].DiscoveryConfig.LabelsKeys == nil {
+			allFabrics[fabricName].DiscoveryConfig.LabelsKeys = v.GetStringSlice("service_discovery.labels")
+		}
+		if allFabrics[fabricName].DiscoveryConfig.TargetFormat == "" {
+			allFabrics[fabricName].DiscoveryConfig.TargetFormat = v.GetString("service_discovery.target_format")
+		}
+	}
+	// Overwrite username or password for APIC by environment variables if set
+	for fabricName := range allFabrics {
+		fabricEnv(fabricName, allFabrics)
+	}
+
+	// Fabrics only configured by environment variables, validated with the other fabrics
+	if val, exists := os.LookupEnv(fmt.Sprintf("%s_FABRIC_NAMES", ExporterNameAsEnv())); exists == true && val != "" {
+		for _, fabricName := range strings.Split(val, ",") {
+			fabricEnv(fabricName, allFabrics)
+		}
+	}
+
+	if err := configLimits(v).validate(); err != nil {
+		return nil, err
+	}
+
+	for fabricName, fabric := range allFabrics {
+		fabric.FabricName = fabricName
+		if err := fabric.Limits.validate(); err != nil {
+			return nil, fmt.Errorf("fabric %s - %s", fabricName, err)
+		}
+		err := fabric.newHTTPClients()
+		if err != nil {
+			return nil, fmt.Errorf("fabric %s - %s", fabricName, err)
+		}
+		if _, ok := secretProviders[fabric.Secret.Provider]; fabric.Secret.Provider != "" && !ok {
+			return nil, fmt.Errorf("fabric %s - secret provider %s is not supported, must be vault or kubernetes",
+				fabricName, fabric.Secret.Provider)
+		}
+	}
+
+	return allFabrics, nil
+}
+
+func readConfigDirectory(configDirName *string, dirPath string, queries *AllQueries) error {
 	configDir := filepath.Join(dirPath, *configDirName)
 	_, err := os.Stat(configDir)
 	if err != nil {
 		log.Info("Configuration directory do not exist - ", err)
-		return
+		return nil
 	}
 
 	files, err := os.ReadDir(configDir)
 	if err != nil {
-		log.Error("Unable to access files in the configuration directory - ", err)
-		os.Exit(1)
+		return fmt.Errorf("unable to access files in the configuration directory - %s", err)
 	}
 
 	for _, file := range files {
 
 		yamlFile, err := os.ReadFile(filepath.Join(configDir, file.Name()))
 		if err != nil {
-			log.Error(fmt.Sprintf("Reading the config file %s failed - ", file.Name()), err)
-			os.Exit(1)
+			return fmt.Errorf("reading the config file %s failed - %s", file.Name(), err)
 		}
 		err = yaml.Unmarshal(yamlFile, &queries)
 		if err != nil {
-			log.Error(fmt.Sprintf("Unmarshal the config file %s failed - ", file.Name()), err)
-			os.Exit(1)
+			return fmt.Errorf("unmarshal the config file %s failed - %s", file.Name(), err)
 		}
 
 		log.WithFields(log.Fields{
 			"file": file.Name(),
 		}).Info("Directory configuration files")
 	}
+	return nil
 }
 
 func fabricEnv(fabricName string, allFabrics map[string]*Fabric) {
@@ -403,6 +540,18 @@ func fabricEnv(fabricName string, allFabrics map[string]*Fabric) {
 	if val, exists := os.LookupEnv(fmt.Sprintf("%s_FABRICS_%s_PASSWORD", ExporterNameAsEnv(), fabricNameAsEnv)); exists == true && val != "" {
 		allFabrics[fabricName].Password = val
 	}
+	if val, exists := os.LookupEnv(fmt.Sprintf("%s_FABRICS_%s_USERNAME_FILE", ExporterNameAsEnv(), fabricNameAsEnv)); exists == true && val != "" {
+		allFabrics[fabricName].UsernameFile = val
+	}
+	if val, exists := os.LookupEnv(fmt.Sprintf("%s_FABRICS_%s_PASSWORD_FILE", ExporterNameAsEnv(), fabricNameAsEnv)); exists == true && val != "" {
+		allFabrics[fabricName].PasswordFile = val
+	}
+	if val, exists := os.LookupEnv(fmt.Sprintf("%s_FABRICS_%s_PRIVATE_KEY_FILE", ExporterNameAsEnv(), fabricNameAsEnv)); exists == true && val != "" {
+		allFabrics[fabricName].PrivateKeyFile = val
+	}
+	if val, exists := os.LookupEnv(fmt.Sprintf("%s_FABRICS_%s_CERTIFICATE_DN", ExporterNameAsEnv(), fabricNameAsEnv)); exists == true && val != "" {
+		allFabrics[fabricName].CertificateDN = val
+	}
 	if val, exists := os.LookupEnv(fmt.Sprintf("%s_FABRICS_%s_ACI_NAME", ExporterNameAsEnv(), fabricNameAsEnv)); exists == true && val != "" {
 		allFabrics[fabricName].AciName = val
 	}
@@ -419,15 +568,20 @@ func cliQuery(ctx context.Context, fabric *string, class *string, query *string)
 		log.Error("Configuration file not valid - ", err)
 		return "", err
 	}
-	username := viper.GetString(fmt.Sprintf("fabrics.%s.username", *fabric))
-	password := viper.GetString(fmt.Sprintf("fabrics.%s.password", *fabric))
-	apicControllers := viper.GetStringSlice(fmt.Sprintf("fabrics.%s.apic", *fabric))
-	aciName := viper.GetString(fmt.Sprintf("fabrics.%s.aci_name", *fabric))
+	fabricConfig := Fabric{}
+	err = viper.UnmarshalKey(fmt.Sprintf("fabrics.%s", *fabric), &fabricConfig)
+	if err != nil {
+		return "", err
+	}
+	fabricConfig.FabricName = *fabric
 
-	fabricConfig := Fabric{Username: username, Password: password, Apic: apicControllers, FabricName: *fabric, AciName: aciName}
+	return fabricQuery(ctx, &fabricConfig, class, query)
+}
 
-	con := newAciConnection(&fabricConfig, nil)
-	err = con.login(ctx)
+// fabricQuery login and return the response of the class query of the fabric
+func fabricQuery(ctx context.Context, fabricConfig *Fabric, class *string, query *string) (string, error) {
+	con := newAciConnection(fabricConfig, nil)
+	err := con.login(ctx)
 	if err != nil {
 		fmt.Printf("Login error %s", err)
 		return "", err
@@ -451,9 +605,59 @@ func cliQuery(ctx context.Context, fabric *string, class *string, query *string)
 type HandlerInit struct {
 	AllQueries AllQueries
 	AllFabrics map[string]*Fabric
+	querySet   mapset.Set[string]
+	// configMutex protect the queries, fabrics and query set that are swapped on reload
+	configMutex sync.RWMutex
+	// If background collection is enabled the scheduler is set
+	scheduler *Scheduler
+	// collections is the executing collections, and loops the background loops, that are waited for on shutdown. No
+	// collections or loops are started after shutdown is set.
+	collections   sync.WaitGroup
+	loops         sync.WaitGroup
+	shutdown      bool
+	shutdownMutex sync.RWMutex
+	// ctx is the root context of the background loops and collections, cancelled on shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+	// fabricLoops is the per fabric loops that are synced with the fabrics on reload
+	fabricLoops []*FabricLoops
+}
+
+// NewHandlerInit create the handler of the queries and fabrics
+func NewHandlerInit(allQueries AllQueries, allFabrics map[string]*Fabric) *HandlerInit {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &HandlerInit{
+		AllQueries: allQueries,
+		AllFabrics: allFabrics,
+		querySet:   createQueryNameSet(allQueries),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// fabrics return the current fabrics
+func (h *HandlerInit) fabrics() map[string]*Fabric {
+	h.configMutex.RLock()
+	defer h.configMutex.RUnlock()
+	return h.AllFabrics
+}
+
+// fabric return the current configuration of the fabric
+func (h *HandlerInit) fabric(fabricName string) (*Fabric, bool) {
+	h.configMutex.RLock()
+	defer h.configMutex.RUnlock()
+	fabricConfig, ok := h.AllFabrics[fabricName]
+	return fabricConfig, ok
+}
+
+// queries return the current queries and the set of the query names
+func (h *HandlerInit) queries() (AllQueries, mapset.Set[string]) {
+	h.configMutex.RLock()
+	defer h.configMutex.RUnlock()
+	return h.AllQueries, h.querySet
 }
 
-func (h HandlerInit) discovery(w http.ResponseWriter, r *http.Request) {
+func (h *HandlerInit) discovery(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
 	fabric := r.URL.Query().Get("target")
@@ -469,7 +673,7 @@ func (h HandlerInit) discovery(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if fabric != "" {
-		_, ok := h.AllFabrics[fabric]
+		_, ok := h.fabric(fabric)
 		if !ok {
 			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
 			w.Header().Set("Content-Length", "0")
@@ -484,7 +688,7 @@ func (h HandlerInit) discovery(w http.ResponseWriter, r *http.Request) {
 
 	discovery := Discovery{
 		Fabric:  fabric,
-		Fabrics: h.AllFabrics,
+		Fabrics: h.fabrics(),
 	}
 
 	lrw := loggingResponseWriter{ResponseWriter: w}
@@ -513,7 +717,7 @@ func formatQueries(queries string) string {
 	return trimQueries
 }
 
-func (h HandlerInit) getMonitorMetrics(w http.ResponseWriter, r *http.Request) {
+func (h *HandlerInit) getMonitorMetrics(w http.ResponseWriter, r *http.Request) {
 
 	openmetrics := false
 	// Check accept header for open metrics
@@ -542,6 +746,8 @@ func (h HandlerInit) getMonitorMetrics(w http.ResponseWriter, r *http.Request) {
 		node = nil
 	}
 
+	_, querySet := h.queries()
+
 	// Handle multiple queries
 	var queries []string
 	for _, queryString := range queryArray {
@@ -576,7 +782,7 @@ func (h HandlerInit) getMonitorMetrics(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if a valid target
-	_, ok := h.AllFabrics[fabric]
+	_, ok := h.fabric(fabric)
 	if !ok {
 		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
 		w.Header().Set("Content-Length", "0")
@@ -590,10 +796,16 @@ func (h HandlerInit) getMonitorMetrics(w http.ResponseWriter, r *http.Request) {
 
 	ctx := r.Context()
 	ctx = context.WithValue(ctx, LogFieldFabric, fabric)
-	api := newAciAPI(ctx, h.AllFabrics[fabric], h.AllQueries, queries, node)
 
 	start := time.Now()
-	aciName, metrics, err := api.CollectMetrics()
+	var aciName string
+	var metrics []MetricDefinition
+	var err error
+	if h.scheduler != nil {
+		aciName, metrics, err = h.scheduler.Get(ctx, fabric, queries, node)
+	} else {
+		aciName, metrics, err = h.collect(ctx, fabric, queries, node)
+	}
 	log.WithFields(log.Fields{
 		LogFieldRequestID: ctx.Value(LogFieldRequestID),
 		LogFieldExecTime:  time.Since(start).Microseconds(),
@@ -607,7 +819,7 @@ func (h HandlerInit) getMonitorMetrics(w http.ResponseWriter, r *http.Request) {
 	start = time.Now()
 	metricsFormat := NewMetricFormat(openmetrics, viper.GetBool("metric_format.label_key_to_lower_case"),
 		viper.GetBool("metric_format.label_key_to_snake_case"))
-	var bodyText = Metrics2Prometheus(metrics, api.metricPrefix, commonLabels, metricsFormat)
+	var bodyText = Metrics2Prometheus(metrics, viper.GetString("prefix"), commonLabels, metricsFormat)
 
 	log.WithFields(log.Fields{
 		LogFieldRequestID: ctx.Value(LogFieldRequestID),
@@ -634,6 +846,27 @@ func (h HandlerInit) getMonitorMetrics(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// collect execute the queries against the fabric, or node if set
+func (h *HandlerInit) collect(ctx context.Context, fabric string, queries []string, node *string) (string, []MetricDefinition, error) {
+	if !h.startCollection() {
+		return "", nil, fmt.Errorf("exporter is shutting down")
+	}
+	defer h.collections.Done()
+
+	// The collection is aborted when the exporter is shut down
+	ctx, cancel := h.withRootContext(ctx)
+	defer cancel()
+
+	fabricConfig, ok := h.fabric(fabric)
+	if !ok {
+		// The fabric may have been removed by a reload
+		return "", nil, fmt.Errorf("fabric %s do not exists", fabric)
+	}
+	allQueries, _ := h.queries()
+	api := newAciAPI(ctx, fabricConfig, allQueries, queries, node)
+	return api.CollectMetrics()
+}
+
 func alive(w http.ResponseWriter, r *http.Request) {
 
 	var alive = fmt.Sprintf("Alive!\n")
@@ -0,0 +1,103 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// Cookie names used by the APIC certificate based authentication
+const (
+	CookieAPICRequestSignature     = "APIC-Request-Signature"
+	CookieAPICCertificateAlgorithm = "APIC-Certificate-Algorithm"
+	CookieAPICCertificateFinger    = "APIC-Certificate-Fingerprint"
+	CookieAPICCertificateDN        = "APIC-Certificate-DN"
+	APICCertificateAlgorithm       = "v1.0"
+	APICCertificateFingerprint     = "fingerprint"
+)
+
+// AciSigner sign every request with the private key of a certificate that is registered on a local APIC user.
+// With certificate based authentication there is no login and no token to refresh.
+type AciSigner struct {
+	privateKey    *rsa.PrivateKey
+	certificateDN string
+}
+
+// newAciSigner read the PEM encoded private key, PKCS #1 or PKCS #8, from keyFile
+func newAciSigner(keyFile string, certificateDN string) (*AciSigner, error) {
+	if certificateDN == "" {
+		return nil, fmt.Errorf("certificate_dn must be set when using private_key_file")
+	}
+
+	keyData, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read private key file %s - %s", keyFile, err)
+	}
+
+	block, _ := pem.Decode(keyData)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in private key file %s", keyFile)
+	}
+
+	var privateKey *rsa.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse private key file %s - %s", keyFile, err)
+		}
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse private key file %s - %s", keyFile, err)
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private key in %s is not a RSA key", keyFile)
+		}
+		privateKey = rsaKey
+	default:
+		return nil, fmt.Errorf("not supported PEM type %s in private key file %s", block.Type, keyFile)
+	}
+
+	return &AciSigner{
+		privateKey:    privateKey,
+		certificateDN: certificateDN,
+	}, nil
+}
+
+// Sign add the APIC signature cookies to the request. The signed payload is the http method, the path including the
+// query string and the request body.
+func (s *AciSigner) Sign(req *http.Request, body []byte) error {
+	payload := req.Method + req.URL.RequestURI() + string(body)
+	hashed := sha256.Sum256([]byte(payload))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.privateKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+
+	req.AddCookie(&http.Cookie{Name: CookieAPICRequestSignature, Value: base64.StdEncoding.EncodeToString(signature)})
+	req.AddCookie(&http.Cookie{Name: CookieAPICCertificateAlgorithm, Value: APICCertificateAlgorithm})
+	req.AddCookie(&http.Cookie{Name: CookieAPICCertificateFinger, Value: APICCertificateFingerprint})
+	req.AddCookie(&http.Cookie{Name: CookieAPICCertificateDN, Value: s.certificateDN})
+	return nil
+}
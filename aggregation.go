@@ -0,0 +1,146 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	AggregationSum   = "sum"
+	AggregationCount = "count"
+	AggregationMin   = "min"
+	AggregationMax   = "max"
+	AggregationAvg   = "avg"
+)
+
+var validAggregations = map[string]bool{
+	AggregationSum:   true,
+	AggregationCount: true,
+	AggregationMin:   true,
+	AggregationMax:   true,
+	AggregationAvg:   true,
+}
+
+// aggregationError return an error if the query has an aggregation block and a metric of a type that can not be
+// aggregated, the distribution of histogram and summary metrics and the labels of info metrics would be lost
+func (c *ClassQuery) aggregationError() error {
+	if c.Aggregation == nil {
+		return nil
+	}
+	for _, mv := range c.Metrics {
+		if mv.Type == MetricTypeHistogram || mv.Type == MetricTypeSummary || mv.Type == MetricTypeInfo {
+			return fmt.Errorf("metric %s of type %s can not be aggregated", mv.Name, mv.Type)
+		}
+	}
+	return nil
+}
+
+// checkAggregations return an error if any class query, or query of a group, can not be aggregated
+func (q AllQueries) checkAggregations() error {
+	for name, query := range q.ClassQueries {
+		if err := query.aggregationError(); err != nil {
+			return fmt.Errorf("class query %s - %s", name, err)
+		}
+	}
+	for name, query := range q.GroupClassQueries {
+		for i := range query.Queries {
+			if err := query.Queries[i].aggregationError(); err != nil {
+				return fmt.Errorf("group class query %s.queries[%d] - %s", name, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// aggregate the values with the function. The result of min, max and avg is not valid, ok is false, if there are no
+// values, while sum and count is 0.
+func aggregate(function string, values []float64) (value float64, ok bool) {
+	switch function {
+	case AggregationCount:
+		return float64(len(values)), true
+	case AggregationSum:
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum, true
+	}
+
+	if len(values) == 0 {
+		return 0, false
+	}
+
+	switch function {
+	case AggregationMin:
+		value = math.Inf(1)
+		for _, v := range values {
+			value = math.Min(value, v)
+		}
+		return value, true
+	case AggregationMax:
+		value = math.Inf(-1)
+		for _, v := range values {
+			value = math.Max(value, v)
+		}
+		return value, true
+	case AggregationAvg:
+		sum, _ := aggregate(AggregationSum, values)
+		return sum / float64(len(values)), true
+	}
+	return 0, false
+}
+
+// aggregateMetrics group the metrics by the values of the group by labels and aggregate the values of each group with
+// the function, default sum. The metrics of a group only keep the group by and static labels.
+func aggregateMetrics(metrics []Metric, groupBy []string, staticLabels []StaticLabels, function string) []Metric {
+	if function == "" {
+		function = AggregationSum
+	}
+
+	groups := make(map[string][]float64)
+	groupLabels := make(map[string]map[string]string)
+	for _, metric := range metrics {
+		labels := make(map[string]string)
+		keys := make([]string, 0, len(groupBy))
+		for _, labelName := range groupBy {
+			labels[labelName] = metric.Labels[labelName]
+			keys = append(keys, metric.Labels[labelName])
+		}
+		for _, slv := range staticLabels {
+			labels[slv.Key] = slv.Value
+		}
+		// The label values can not include a null character
+		key := strings.Join(keys, "\x00")
+		groups[key] = append(groups[key], metric.Value)
+		groupLabels[key] = labels
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var aggregated []Metric
+	for _, key := range keys {
+		value, ok := aggregate(function, groups[key])
+		if !ok {
+			continue
+		}
+		aggregated = append(aggregated, Metric{Labels: groupLabels[key], Value: value})
+	}
+	return aggregated
+}
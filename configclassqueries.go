@@ -11,17 +11,22 @@
 
 package main
 
+import "strings"
+
 type ClassQueries map[string]*ClassQuery
 type CompoundClassQueries map[string]*CompoundClassQuery
 type GroupClassQueries map[string]*GroupClassQuery
 
 // BuiltinQueries BuiltinQueries queries named and point to a function to execute
-type BuiltinQueries map[string]func(chan []MetricDefinition)
+type BuiltinQueries map[string]func(aciAPI) ([]MetricDefinition, error)
 
 type AllQueries struct {
 	ClassQueries         ClassQueries         `yaml:"class_queries"`
 	CompoundClassQueries CompoundClassQueries `yaml:"compound_queries"`
 	GroupClassQueries    GroupClassQueries    `yaml:"group_class_queries"`
+	// RelabelConfigs is the global relabel_configs of the configuration file, applied to the metrics of all queries
+	// after the query rules
+	RelabelConfigs []RelabelConfig `yaml:"-"`
 }
 
 type GroupClassQuery struct {
@@ -31,6 +36,10 @@ type GroupClassQuery struct {
 	Help         string         `mapstructure:"help" yaml:"help"`
 	Queries      []ClassQuery   `string:"queries"`
 	StaticLabels []StaticLabels `string:"staticlabels"`
+	// Limits of the group query, override the limits of the fabric
+	Limits *QueryLimits `mapstructure:"limits" yaml:"limits"`
+	// RelabelConfigs is applied to the metrics of all queries of the group
+	RelabelConfigs []RelabelConfig `mapstructure:"relabel_configs" yaml:"relabel_configs"`
 }
 
 // ClassQuery define the structure of configured queries
@@ -40,6 +49,57 @@ type ClassQuery struct {
 	Metrics        []ConfigMetric `string:"metrics"`
 	Labels         []ConfigLabels `string:"labels"`
 	StaticLabels   []StaticLabels `string:"staticlabels"`
+	// Subscription is set if the objects should be kept updated by a subscription instead of polled
+	Subscription bool `mapstructure:"subscription" yaml:"subscription"`
+	// Aggregation is set if the metrics should be aggregated by labels instead of one metric per object
+	Aggregation *ConfigAggregation `mapstructure:"aggregation" yaml:"aggregation"`
+	// Limits of the query, override the limits of the fabric
+	Limits *QueryLimits `mapstructure:"limits" yaml:"limits"`
+	// RelabelConfigs is applied to the metrics of the query before the global relabel_configs
+	RelabelConfigs []RelabelConfig `mapstructure:"relabel_configs" yaml:"relabel_configs"`
+	// NodeJoin is set if the labels of the node, from the node cache, should be added to the metrics
+	NodeJoin *ConfigNodeJoin `mapstructure:"node_join" yaml:"node_join"`
+	// Joins add labels from the objects of other class queries
+	Joins []ConfigJoin `mapstructure:"joins" yaml:"joins"`
+}
+
+// ConfigJoin define a class query whose objects are joined to the objects of the query, and the labels to add from
+// the joined objects. The objects are joined on the value of property_name and join_property_name, or if
+// property_name is not set, the joined object is the object whose dn is the longest prefix of the dn of the object.
+type ConfigJoin struct {
+	ClassName        string `mapstructure:"class_name" yaml:"class_name"`
+	QueryParameter   string `mapstructure:"query_parameter" yaml:"query_parameter"`
+	PropertyName     string `mapstructure:"property_name" yaml:"property_name"`
+	JoinPropertyName string `mapstructure:"join_property_name" yaml:"join_property_name"`
+	// Labels is parsed from the joined object
+	Labels []ConfigLabels `mapstructure:"labels" yaml:"labels"`
+	// TTL is the seconds the objects of the class query are cached, default join_cache.ttl
+	TTL int `mapstructure:"ttl" yaml:"ttl"`
+}
+
+// ConfigNodeJoin define the label with the node id and the node labels to add, node_name, role, model and serial
+type ConfigNodeJoin struct {
+	NodeIDLabel string   `mapstructure:"node_id_label" yaml:"node_id_label"`
+	Labels      []string `mapstructure:"labels" yaml:"labels"`
+}
+
+// labels return the node id label, default nodeid, and the node labels to add, default all
+func (j ConfigNodeJoin) labels() (string, []string) {
+	nodeIDLabel := j.NodeIDLabel
+	if nodeIDLabel == "" {
+		nodeIDLabel = "nodeid"
+	}
+	labels := j.Labels
+	if len(labels) == 0 {
+		labels = nodeLabels
+	}
+	return nodeIDLabel, labels
+}
+
+// ConfigAggregation group the metrics of a class query by the labels, the value of a group is the aggregation of the
+// metric, default sum. Without group_by all objects are aggregated to a single metric.
+type ConfigAggregation struct {
+	GroupBy []string `mapstructure:"group_by" yaml:"group_by"`
 }
 
 // ConfigMetric define the configuration of metric
@@ -52,6 +112,35 @@ type ConfigMetric struct {
 	Help                string             `mapstructure:"help" yaml:"help"`
 	ValueTransform      map[string]float64 `mapstructure:"value_transform" yaml:"value_transform"`
 	ValueRegexTransform string             `mapstructure:"value_regex_transformation" yaml:"value_regex_transformation"`
+	// Buckets is used for the type histogram and Quantiles for the type summary
+	Buckets   []ConfigBucket   `mapstructure:"buckets" yaml:"buckets"`
+	Quantiles []ConfigQuantile `mapstructure:"quantiles" yaml:"quantiles"`
+	// CumulativeBuckets is set if the bucket values are already cumulative, else the exporter accumulate them
+	CumulativeBuckets bool   `mapstructure:"cumulative_buckets" yaml:"cumulative_buckets"`
+	SumValueName      string `mapstructure:"sum_value_name" yaml:"sum_value_name"`
+	CountValueName    string `mapstructure:"count_value_name" yaml:"count_value_name"`
+	// Aggregation is sum, count, min, max or avg of the values of all rows
+	Aggregation string `mapstructure:"aggregation" yaml:"aggregation"`
+	// Attributes is used for the type info, the value of each attribute path is a label named by the last element
+	// of the path
+	Attributes []string `mapstructure:"attributes" yaml:"attributes"`
+}
+
+// infoLabelName return the label name of an info attribute path, the last element of the path
+func infoLabelName(attribute string) string {
+	return attribute[strings.LastIndex(attribute, ".")+1:]
+}
+
+// ConfigBucket define the upper bound of a histogram bucket, like 0.5 or +Inf, and the property with the bucket value
+type ConfigBucket struct {
+	UpperBound string `mapstructure:"le" yaml:"le"`
+	ValueName  string `mapstructure:"value_name" yaml:"value_name"`
+}
+
+// ConfigQuantile define the quantile of a summary, like 0.99, and the property with the quantile value
+type ConfigQuantile struct {
+	Quantile  float64 `mapstructure:"quantile" yaml:"quantile"`
+	ValueName string  `mapstructure:"value_name" yaml:"value_name"`
 }
 
 // ConfigLabels define the configuration of label to parse
@@ -70,6 +159,10 @@ type CompoundClassQuery struct {
 	ClassNames []ClassLabelMapping `string:"classnames"`
 	Metrics    []ConfigMetric      `string:"metrics"`
 	LabelName  string              `mapstructure:"labelname"`
+	// Limits of the query, override the limits of the fabric
+	Limits *QueryLimits `mapstructure:"limits" yaml:"limits"`
+	// RelabelConfigs is applied to the metrics of the query before the global relabel_configs
+	RelabelConfigs []RelabelConfig `mapstructure:"relabel_configs" yaml:"relabel_configs"`
 }
 
 type ClassLabelMapping struct {
@@ -0,0 +1,191 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var sessionsMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: MetricsPrefix + "cached_sessions",
+	Help: "Number of cached connections to the apic and nodes of the fabric",
+},
+	[]string{"fabric"},
+)
+
+var evictedMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: MetricsPrefix + "evicted_sessions",
+	Help: "Number of idle node connections evicted from the connection cache",
+},
+	[]string{"fabric"},
+)
+
+// sessionFabrics is the fabrics with a sessions metric, so the metric is removed for fabrics without connections
+var sessionFabrics = make(map[string]bool)
+
+// updateSessionsMetric set the number of cached connections by fabric. Called with the connection cache locked.
+func updateSessionsMetric() {
+	sessions := make(map[string]int)
+	for _, con := range connectionCache {
+		sessions[con.fabricConfig.FabricName]++
+	}
+	for fabricName := range sessionFabrics {
+		if _, ok := sessions[fabricName]; !ok {
+			sessionsMetric.DeleteLabelValues(fabricName)
+			delete(sessionFabrics, fabricName)
+		}
+	}
+	for fabricName, count := range sessions {
+		sessionsMetric.With(prometheus.Labels{LogFieldFabric: fabricName}).Set(float64(count))
+		sessionFabrics[fabricName] = true
+	}
+}
+
+// touch set the connection as used now
+func (c *AciConnection) touch() {
+	c.lastUsed.Store(time.Now().Unix())
+}
+
+// StartConnectionEviction evict node connections idle longer than connection_cache.node_idle_timeout seconds
+func StartConnectionEviction(handler *HandlerInit) {
+	idleTimeout := viper.GetDuration("connection_cache.node_idle_timeout") * time.Second
+	if idleTimeout <= 0 {
+		return
+	}
+
+	interval := idleTimeout / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	log.WithFields(log.Fields{
+		"node_idle_timeout": idleTimeout.Seconds(),
+	}).Info("start connection cache eviction")
+
+	handler.startLoop(func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				evictIdleConnections(idleTimeout)
+			}
+		}
+	})
+}
+
+// evictIdleConnections remove the node connections not used within the idle timeout and logout their sessions
+func evictIdleConnections(idleTimeout time.Duration) {
+	idleSince := time.Now().Add(-idleTimeout).Unix()
+
+	connectionCacheMutex.Lock()
+	var evicted []*AciConnection
+	for name, con := range connectionCache {
+		if con.Node != nil && con.lastUsed.Load() < idleSince {
+			delete(connectionCache, name)
+			evicted = append(evicted, con)
+			evictedMetric.With(prometheus.Labels{LogFieldFabric: con.fabricConfig.FabricName}).Inc()
+		}
+	}
+	if len(evicted) > 0 {
+		updateSessionsMetric()
+	}
+	connectionCacheMutex.Unlock()
+
+	for _, con := range evicted {
+		log.WithFields(log.Fields{
+			LogFieldFabric: con.fabricConfig.FabricName,
+			"node":         *con.Node,
+		}).Info("evict idle node connection")
+	}
+	logoutConnections(evicted)
+}
+
+// logoutAllConnections remove all connections from the cache and logout their sessions
+func logoutAllConnections() {
+	connectionCacheMutex.Lock()
+	connections := make([]*AciConnection, 0, len(connectionCache))
+	for name, con := range connectionCache {
+		delete(connectionCache, name)
+		connections = append(connections, con)
+	}
+	updateSessionsMetric()
+	connectionCacheMutex.Unlock()
+
+	logoutConnections(connections)
+}
+
+// logoutConnections logout the sessions of the connections in parallel
+func logoutConnections(connections []*AciConnection) {
+	var wg sync.WaitGroup
+	for _, con := range connections {
+		wg.Add(1)
+		go func(con *AciConnection) {
+			defer wg.Done()
+			ctx := context.WithValue(context.Background(), LogFieldRequestID, nextRequestID())
+			ctx = context.WithValue(ctx, LogFieldFabric, con.fabricConfig.FabricName)
+			_ = con.logout(ctx)
+		}(con)
+	}
+	wg.Wait()
+}
+
+// logout the session of the connection. Certificate based authentication has no session.
+func (c *AciConnection) logout(ctx context.Context) error {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+
+	token := c.token.Load()
+	if token == nil {
+		return nil
+	}
+	c.token.Store(nil)
+
+	username, _, err := c.credentials(ctx)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s%s", c.controller(), c.URLMap["logout"])
+	if c.Node != nil {
+		url = fmt.Sprintf("%s%s", *c.Node, c.URLMap["logout"])
+	}
+	_, status, err := c.doPostJSON(ctx, "logout", url, token,
+		aaaUserBody(username, ""))
+	if err == nil && status != 200 {
+		err = fmt.Errorf(ACIApiReturnedStatusCode, status)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			LogFieldRequestID: ctx.Value(LogFieldRequestID),
+			LogFieldFabric:    c.fabricConfig.FabricName,
+			"token":           "logout",
+		}).Warning("logout failed - ", err)
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		LogFieldRequestID: ctx.Value(LogFieldRequestID),
+		LogFieldFabric:    c.fabricConfig.FabricName,
+		"token":           "logout",
+	}).Info("logout")
+	return nil
+}
@@ -0,0 +1,181 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var controllerUpMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: MetricsPrefix + "apic_controller_up",
+	Help: "The state of the apic controller 1=UP, 0=DOWN, based on the latest request to the controller",
+},
+	[]string{"fabric", "controller"},
+)
+
+var retryMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: MetricsPrefix + "request_retries",
+	Help: "Number of retried requests",
+},
+	[]string{"fabric"},
+)
+
+var failoverMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: MetricsPrefix + "apic_failover",
+	Help: "Number of switches to another apic controller",
+},
+	[]string{"fabric"},
+)
+
+// controller return the url of the active apic controller
+func (c *AciConnection) controller() string {
+	c.controllerMutex.Lock()
+	defer c.controllerMutex.Unlock()
+	return c.fabricConfig.Apic[c.activeController]
+}
+
+// setController set the active apic controller and its state to up
+func (c *AciConnection) setController(index int) {
+	c.controllerMutex.Lock()
+	c.activeController = index
+	c.controllerMutex.Unlock()
+	c.setControllerState(index, true)
+}
+
+// controllerIndex return the index of the apic controller of the url, or -1 if not an apic url
+func (c *AciConnection) controllerIndex(url string) int {
+	if c.Node != nil {
+		return -1
+	}
+	for i, controller := range c.fabricConfig.Apic {
+		if strings.HasPrefix(url, controller+"/") {
+			return i
+		}
+	}
+	return -1
+}
+
+// setControllerState record if the apic controller is up or down
+func (c *AciConnection) setControllerState(index int, up bool) {
+	c.controllerMutex.Lock()
+	if c.controllerDown == nil {
+		c.controllerDown = make(map[int]bool)
+	}
+	c.controllerDown[index] = !up
+	c.controllerMutex.Unlock()
+
+	value := 0.0
+	if up {
+		value = 1.0
+	}
+	controllerUpMetric.With(prometheus.Labels{
+		LogFieldFabric: c.fabricConfig.FabricName,
+		"controller":   c.fabricConfig.Apic[index],
+	}).Set(value)
+}
+
+// updateControllerState set the state of the apic controller of the url from the result of the request. A connection
+// error or 5xx is down, any other response is up.
+func (c *AciConnection) updateControllerState(url string, status int, err error) {
+	index := c.controllerIndex(url)
+	if index < 0 {
+		return
+	}
+	c.setControllerState(index, !controllerFailed(status, err))
+}
+
+// failover switch to the next apic controller that is not down, or the next controller if all are down, and return
+// the url for the new controller. Only the controller of the url is switched, if another request already switched the
+// active controller it is kept.
+func (c *AciConnection) failover(ctx context.Context, url string) string {
+	index := c.controllerIndex(url)
+	if index < 0 || len(c.fabricConfig.Apic) < 2 {
+		return url
+	}
+
+	c.controllerMutex.Lock()
+	next := (index + 1) % len(c.fabricConfig.Apic)
+	for i := 1; i < len(c.fabricConfig.Apic); i++ {
+		candidate := (index + i) % len(c.fabricConfig.Apic)
+		if !c.controllerDown[candidate] {
+			next = candidate
+			break
+		}
+	}
+	if c.activeController == index {
+		c.activeController = next
+	}
+	c.controllerMutex.Unlock()
+
+	failoverMetric.With(prometheus.Labels{LogFieldFabric: c.fabricConfig.FabricName}).Inc()
+	log.WithFields(log.Fields{
+		LogFieldRequestID: ctx.Value(LogFieldRequestID),
+		LogFieldFabric:    c.fabricConfig.FabricName,
+		"controller":      c.fabricConfig.Apic[next],
+	}).Warning(fmt.Sprintf("failover from apic %s", c.fabricConfig.Apic[index]))
+
+	return c.fabricConfig.Apic[next] + strings.TrimPrefix(url, c.fabricConfig.Apic[index])
+}
+
+// removeControllerStates remove the controller metrics of the fabric
+func removeControllerStates(fabricConfig *Fabric) {
+	for _, controller := range fabricConfig.Apic {
+		controllerUpMetric.DeleteLabelValues(fabricConfig.FabricName, controller)
+	}
+}
+
+// controllerFailed is true if the request failed by a connection error or a 5xx response
+func controllerFailed(status int, err error) bool {
+	if status >= 500 {
+		return true
+	}
+	var limitErr *LimitExceededError
+	return err != nil && status == 0 && !errors.As(err, &limitErr)
+}
+
+// retryable is true if a failed request may succeed if retried, a connection error, 5xx or 429
+func retryable(status int, err error) bool {
+	return controllerFailed(status, err) || status == http.StatusTooManyRequests
+}
+
+// retryBackoff return the time to wait before the retry, doubled for every attempt up to the max backoff
+func retryBackoff(attempt int) time.Duration {
+	backoff := viper.GetFloat64("httpclient.retry_backoff") * math.Pow(2, float64(attempt))
+	maxBackoff := viper.GetFloat64("httpclient.retry_max_backoff")
+	if maxBackoff > 0 && backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return time.Duration(backoff * float64(time.Second))
+}
+
+// sleepContext wait for the duration, false if the context was done before
+func sleepContext(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,116 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// newRetryTestConnection return a logged in connection to an apic that respond to class queries with the handler
+func newRetryTestConnection(t *testing.T, handler http.HandlerFunc) *AciConnection {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/aaaLogin.json", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"totalCount":"1","imdata":[{"aaaLogin":{"attributes":{"token":"retry-token",` +
+			`"refreshTimeoutSeconds":"600","maximumLifetimeSeconds":"86400"}}}]}`))
+	})
+	mux.HandleFunc("/api/class/", handler)
+	server := httptest.NewServer(mux)
+
+	SetDefaultValues()
+	viper.Set("httpclient.retries", 5)
+	viper.Set("httpclient.retry_backoff", 10)
+	viper.Set("httpclient.retry_max_backoff", 10)
+	t.Cleanup(func() {
+		removeConnections("retry")
+		server.Close()
+		viper.Reset()
+	})
+
+	con := newAciConnection(&Fabric{FabricName: "retry", Username: "admin", Password: "pw",
+		Apic: []string{server.URL}}, nil)
+	if err := con.login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return con
+}
+
+func TestRetryBackoffCancelled(t *testing.T) {
+	var requests atomic.Int32
+	con := newRetryTestConnection(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, status, err := con.get(ctx, "fvTenant", con.controller()+"/api/class/fvTenant.json")
+	if err == nil || status != http.StatusServiceUnavailable {
+		t.Errorf("expected the 503 of the failed request, got %d %v", status, err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("the backoff was not cancelled by the context")
+	}
+	if requests.Load() != 1 {
+		t.Errorf("expected no retry after the context was done, got %d requests", requests.Load())
+	}
+}
+
+func TestCancelledRequestKeepControllerUp(t *testing.T) {
+	con := newRetryTestConnection(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, _, err := con.get(ctx, "fvTenant", con.controller()+"/api/class/fvTenant.json")
+	if err == nil {
+		t.Fatal("expected the request to be cancelled")
+	}
+	con.controllerMutex.Lock()
+	defer con.controllerMutex.Unlock()
+	if con.controllerDown[0] {
+		t.Errorf("a cancelled request should not mark the controller as down")
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		status    int
+		err       error
+		failed    bool
+		retryable bool
+	}{
+		{status: http.StatusServiceUnavailable, failed: true, retryable: true},
+		{status: http.StatusTooManyRequests, retryable: true},
+		{status: http.StatusBadRequest},
+		{status: 0, err: context.DeadlineExceeded, failed: true, retryable: true},
+		{status: 0, err: &LimitExceededError{}},
+	}
+	for _, test := range tests {
+		if controllerFailed(test.status, test.err) != test.failed || retryable(test.status, test.err) != test.retryable {
+			t.Errorf("status %d err %v expected failed %v retryable %v", test.status, test.err, test.failed,
+				test.retryable)
+		}
+	}
+}
@@ -32,70 +32,239 @@ func ExporterNameAsEnv() string {
 
 // SetDefaultValues define all default values
 func SetDefaultValues() {
+	setDefaultValues(viper.GetViper())
+}
+
+// setDefaultValues define all default values of the viper instance, also used for the instance of a reload
+func setDefaultValues(v *viper.Viper) {
 
 	// If set as env vars use the ExporterName as prefix like ACI_EXPORTER_PORT for the port var
-	viper.SetEnvPrefix(ExporterNameAsEnv())
+	v.SetEnvPrefix(ExporterNameAsEnv())
 
 	// All fields with . will be replaced with _ for ENV vars
-	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-	viper.AutomaticEnv()
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
 
 	// aci-exporter
-	viper.SetDefault("port", 9643)
-	viper.BindEnv("port")
-	viper.SetDefault("logfile", "")
-	viper.BindEnv("logfile")
-	viper.SetDefault("logformat", "json")
-	viper.BindEnv("logformat")
-	viper.SetDefault("loglevel", "info")
-	viper.BindEnv("loglevel")
-	viper.SetDefault("config", "config")
-	viper.BindEnv("config")
-	viper.SetDefault("config_dir", "config.d")
-	viper.BindEnv("config_dir")
-	viper.SetDefault("prefix", "aci_")
-	viper.BindEnv("prefix")
-	viper.SetDefault("pport", "localhost:6060")
-	viper.BindEnv("pport")
+	v.SetDefault("port", 9643)
+	v.BindEnv("port")
+	v.SetDefault("logfile", "")
+	v.BindEnv("logfile")
+	v.SetDefault("logformat", "json")
+	v.BindEnv("logformat")
+	v.SetDefault("loglevel", "info")
+	v.BindEnv("loglevel")
+	v.SetDefault("config", "config")
+	v.BindEnv("config")
+	v.SetDefault("config_dir", "config.d")
+	v.BindEnv("config_dir")
+	v.SetDefault("prefix", "aci_")
+	v.BindEnv("prefix")
+	v.SetDefault("pport", "localhost:6060")
+	v.BindEnv("pport")
 
 	// If set to true response will always be in openmetrics format
-	viper.SetDefault("openmetrics", false)
-	viper.BindEnv("openmetrics")
+	v.SetDefault("openmetrics", false)
+	v.BindEnv("openmetrics")
 
 	// HTTPClient - used for connecting to APIC
-	viper.SetDefault("HTTPClient.timeout", 0)
-	viper.BindEnv("HTTPClient.timeout")
+	v.SetDefault("HTTPClient.timeout", 0)
+	v.BindEnv("HTTPClient.timeout")
 
-	viper.SetDefault("HTTPClient.keepalive", 15)
-	viper.BindEnv("HTTPClient.keepalive")
+	v.SetDefault("HTTPClient.keepalive", 15)
+	v.BindEnv("HTTPClient.keepalive")
 
 	// The page size when using paging
-	viper.SetDefault("HTTPClient.pagesize", 1000)
-	viper.BindEnv("HTTPClient.pagesize")
+	v.SetDefault("HTTPClient.pagesize", 1000)
+	v.BindEnv("HTTPClient.pagesize")
 
 	// If parallel paging is enabled the exporter will fetch multiple pages at the same time
-	viper.SetDefault("HTTPClient.parallel_paging", false)
-	viper.BindEnv("HTTPClient.parallel_paging")
+	v.SetDefault("HTTPClient.parallel_paging", false)
+	v.BindEnv("HTTPClient.parallel_paging")
+
+	// Failed requests, by connection errors, 5xx or 429, are retried with a backoff in seconds that is doubled for
+	// every retry up to the max backoff
+	v.SetDefault("HTTPClient.retries", 2)
+	v.BindEnv("HTTPClient.retries")
+
+	v.SetDefault("HTTPClient.retry_backoff", 0.5)
+	v.BindEnv("HTTPClient.retry_backoff")
+
+	v.SetDefault("HTTPClient.retry_max_backoff", 5)
+	v.BindEnv("HTTPClient.retry_max_backoff")
+
+	// The max number of concurrent requests to the apic, and to each node, of a fabric, 0 is no limit
+	v.SetDefault("HTTPClient.max_inflight_requests", 0)
+	v.BindEnv("HTTPClient.max_inflight_requests")
 
-	// This is currently not used
-	viper.SetDefault("HTTPClient.tlshandshaketimeout", 10)
-	viper.BindEnv("HTTPClient.tlshandshaketimeout")
+	v.SetDefault("HTTPClient.tlshandshaketimeout", 10)
+	v.BindEnv("HTTPClient.tlshandshaketimeout")
 
-	viper.SetDefault("HTTPClient.insecureHTTPS", true)
-	viper.BindEnv("HTTPClient.insecureHTTPS")
+	v.SetDefault("HTTPClient.insecureHTTPS", true)
+	v.BindEnv("HTTPClient.insecureHTTPS")
 
 	// HTTPServer
-	viper.SetDefault("httpserver.read_timeout", 0)
-	viper.BindEnv("httpserver.read_timeout")
+	v.SetDefault("httpserver.read_timeout", 0)
+	v.BindEnv("httpserver.read_timeout")
+
+	v.SetDefault("httpserver.write_timeout", 0)
+	v.BindEnv("httpserver.write_timeout")
+
+	// The max seconds to wait for executing scrapes on shutdown
+	v.SetDefault("httpserver.shutdown_timeout", 30)
+	v.BindEnv("httpserver.shutdown_timeout")
+
+	// Background collection, if enabled the queries are executed on the interval and /probe return the latest result
+	v.SetDefault("background_collection.enabled", false)
+	v.BindEnv("background_collection.enabled")
+
+	v.SetDefault("background_collection.interval", 60)
+	v.BindEnv("background_collection.interval")
+
+	// A background collection that has not been requested within the idle timeout is stopped, 0 is never
+	v.SetDefault("background_collection.idle_timeout", 600)
+	v.BindEnv("background_collection.idle_timeout")
+
+	// OTLP, if enabled the metrics of all fabrics are pushed to the endpoint on the interval
+	v.SetDefault("otlp.enabled", false)
+	v.BindEnv("otlp.enabled")
+
+	// For grpc host:port, e.g. localhost:4317, for http the full url, e.g. http://localhost:4318/v1/metrics
+	v.SetDefault("otlp.endpoint", "")
+	v.BindEnv("otlp.endpoint")
+
+	// grpc or http
+	v.SetDefault("otlp.protocol", "grpc")
+	v.BindEnv("otlp.protocol")
+
+	v.SetDefault("otlp.interval", 60)
+	v.BindEnv("otlp.interval")
+
+	v.SetDefault("otlp.timeout", 30)
+	v.BindEnv("otlp.timeout")
+
+	// No TLS for grpc
+	v.SetDefault("otlp.insecure", false)
+	v.BindEnv("otlp.insecure")
+
+	v.SetDefault("otlp.insecure_skip_verify", false)
+	v.BindEnv("otlp.insecure_skip_verify")
+
+	// Event streaming, if enabled new records of the classes are forwarded to the sink
+	v.SetDefault("event_streaming.enabled", false)
+	v.BindEnv("event_streaming.enabled")
+
+	v.SetDefault("event_streaming.interval", 60)
+	v.BindEnv("event_streaming.interval")
+
+	// Events and the audit log
+	v.SetDefault("event_streaming.classes", []string{"eventRecord", "aaaModLR"})
+
+	// stdout, syslog or loki
+	v.SetDefault("event_streaming.sink.type", "stdout")
+	v.BindEnv("event_streaming.sink.type")
+
+	v.SetDefault("event_streaming.sink.syslog.network", "udp")
+	v.BindEnv("event_streaming.sink.syslog.network")
+
+	v.SetDefault("event_streaming.sink.syslog.address", "localhost:514")
+	v.BindEnv("event_streaming.sink.syslog.address")
+
+	// 16 is local0
+	v.SetDefault("event_streaming.sink.syslog.facility", 16)
+	v.BindEnv("event_streaming.sink.syslog.facility")
+
+	// The Loki push api, e.g. http://loki:3100/loki/api/v1/push
+	v.SetDefault("event_streaming.sink.loki.url", "")
+	v.BindEnv("event_streaming.sink.loki.url")
+
+	v.SetDefault("event_streaming.sink.loki.timeout", 30)
+	v.BindEnv("event_streaming.sink.loki.timeout")
+
+	// Subscriptions, if enabled class queries with subscription are updated by the apic websocket instead of polled
+	v.SetDefault("subscriptions.enabled", false)
+	v.BindEnv("subscriptions.enabled")
+
+	// The apic subscription timeout is 90 seconds
+	v.SetDefault("subscriptions.refresh_interval", 30)
+	v.BindEnv("subscriptions.refresh_interval")
+
+	// The time to wait before subscribe again after a failure or a closed websocket
+	v.SetDefault("subscriptions.retry_interval", 30)
+	v.BindEnv("subscriptions.retry_interval")
+
+	// Limits of all queries, may be overridden per fabric and query, 0 is no limit
+	v.SetDefault("limits.max_series", 0)
+	v.BindEnv("limits.max_series")
+
+	v.SetDefault("limits.max_response_bytes", 0)
+	v.BindEnv("limits.max_response_bytes")
+
+	// The max number of pages of a query with order-by
+	v.SetDefault("limits.max_pages", 0)
+	v.BindEnv("limits.max_pages")
+
+	// truncate, drop or fail when a limit is exceeded
+	v.SetDefault("limits.action", LimitActionDrop)
+	v.BindEnv("limits.action")
+
+	// Node cache, if enabled the nodes of all fabrics are cached and queries with node_join get the node labels
+	v.SetDefault("node_cache.enabled", false)
+	v.BindEnv("node_cache.enabled")
+
+	v.SetDefault("node_cache.refresh_interval", 300)
+	v.BindEnv("node_cache.refresh_interval")
+
+	// Node connections not used for the seconds are removed and logged out, 0 keep the connections
+	v.SetDefault("connection_cache.node_idle_timeout", 900)
+	v.BindEnv("connection_cache.node_idle_timeout")
+
+	// The default seconds the objects of a join class query are cached
+	v.SetDefault("join_cache.ttl", 300)
+	v.BindEnv("join_cache.ttl")
+
+	// The built-in fault_instances is only executed by default if enabled, else it must be included in the queries
+	v.SetDefault("fault_instances.enabled", false)
+	v.BindEnv("fault_instances.enabled")
+
+	// Only active faults, the order-by enable paging
+	v.SetDefault("fault_instances.query_parameter", "?order-by=faultInst.dn&query-target-filter=ne(faultInst.severity,%22cleared%22)")
+	v.BindEnv("fault_instances.query_parameter")
+
+	// The bearer token required by POST /-/reload, if not set the endpoint is not enabled
+	v.SetDefault("reload.token", "")
+	v.BindEnv("reload.token")
+
+	// If set all responses from the apic and nodes are recorded in the directory, see -fake_apic
+	v.SetDefault("recording.directory", "")
+	v.BindEnv("recording.directory")
+
+	// Vault secret provider, the token can be set by the environment variable ACI_EXPORTER_SECRET_PROVIDERS_VAULT_TOKEN
+	v.SetDefault("secret_providers.vault.address", "http://127.0.0.1:8200")
+	v.BindEnv("secret_providers.vault.address")
+
+	v.SetDefault("secret_providers.vault.token", "")
+	v.BindEnv("secret_providers.vault.token")
+
+	// A token file, e.g. written by the vault agent, is read every time a secret is read
+	v.SetDefault("secret_providers.vault.token_file", "")
+	v.BindEnv("secret_providers.vault.token_file")
+
+	v.SetDefault("secret_providers.vault.namespace", "")
+	v.BindEnv("secret_providers.vault.namespace")
+
+	// The seconds a secret is cached before read again, a failed login always read the secret again
+	v.SetDefault("secret_providers.vault.cache_ttl", 300)
+	v.BindEnv("secret_providers.vault.cache_ttl")
 
-	viper.SetDefault("httpserver.write_timeout", 0)
-	viper.BindEnv("httpserver.write_timeout")
+	v.SetDefault("secret_providers.vault.timeout", 10)
+	v.BindEnv("secret_providers.vault.timeout")
 
 	// Service discovery
-	viper.SetDefault("service_discovery.labels", []string{"address", "dn", "fabricDomain", "fabricId", "id",
+	v.SetDefault("service_discovery.labels", []string{"address", "dn", "fabricDomain", "fabricId", "id",
 		"inbMgmtAddr", "name", "nameAlias", "nodeType", "oobMgmtAddr", "podId", "role", "serial", "siteId", "state",
 		"version",
 	})
-	viper.SetDefault("service_discovery.target_fields", []string{"aci_exporter_fabric", "oobMgmtAddr"})
-	viper.SetDefault("service_discovery.target_format", "%s#%s")
+	v.SetDefault("service_discovery.target_fields", []string{"aci_exporter_fabric", "oobMgmtAddr"})
+	v.SetDefault("service_discovery.target_format", "%s#%s")
 }
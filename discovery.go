@@ -88,7 +88,7 @@ func (d Discovery) DoDiscovery(ctx context.Context) ([]ServiceDiscovery, error)
 func (d Discovery) getInfraCont(ctx context.Context, fabricName string) (string, error) {
 	class := "infraCont"
 	query := "?query-target=self"
-	data, err := cliQuery(ctx, &fabricName, &class, &query)
+	data, err := fabricQuery(ctx, d.Fabrics[fabricName], &class, &query)
 
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -127,7 +127,7 @@ func (d Discovery) getInfraCont(ctx context.Context, fabricName string) (string,
 func (d Discovery) getTopSystem(ctx context.Context, fabricName string) []TopSystem {
 	class := "topSystem"
 	query := ""
-	data, err := cliQuery(ctx, &fabricName, &class, &query)
+	data, err := fabricQuery(ctx, d.Fabrics[fabricName], &class, &query)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"function": "discovery",
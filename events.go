@@ -0,0 +1,263 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
+)
+
+// The time format used by the apic for created
+const apicTimeFormat = "2006-01-02T15:04:05.000-07:00"
+
+var eventsForwardedMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: MetricsPrefix + "events_forwarded",
+	Help: "Number of events and audit log records forwarded to the sink",
+},
+	[]string{"fabric", "class"},
+)
+
+var eventsFailedMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: MetricsPrefix + "events_failed",
+	Help: "Number of failed polls or forwards of events and audit log records",
+},
+	[]string{"fabric", "class"},
+)
+
+// Event a single record of an event class like eventRecord or aaaModLR
+type Event struct {
+	Fabric     string
+	Class      string
+	ID         string
+	Created    time.Time
+	Attributes map[string]string
+}
+
+// EventSink forward events to a log destination
+type EventSink interface {
+	Send(ctx context.Context, events []Event) error
+}
+
+// EventStreamer poll the event classes of the fabrics and forward new records to the sink
+type EventStreamer struct {
+	handler  *HandlerInit
+	sink     EventSink
+	interval time.Duration
+	fabrics  []string
+	classes  []string
+}
+
+// eventPoller keep the state of a single class of a fabric
+type eventPoller struct {
+	fabric string
+	class  string
+	// lastCreated is the created time of the latest forwarded record
+	lastCreated time.Time
+	// seen is the id of forwarded records created at or after lastCreated, since the filter include lastCreated
+	seen map[string]time.Time
+}
+
+// NewEventStreamer create the streamer and the sink from the event_streaming configuration
+func NewEventStreamer(handler *HandlerInit) (*EventStreamer, error) {
+	sink, err := newEventSink(viper.GetString("event_streaming.sink.type"))
+	if err != nil {
+		return nil, err
+	}
+	return &EventStreamer{
+		handler:  handler,
+		sink:     sink,
+		interval: viper.GetDuration("event_streaming.interval") * time.Second,
+		fabrics:  viper.GetStringSlice("event_streaming.fabrics"),
+		classes:  viper.GetStringSlice("event_streaming.classes"),
+	}, nil
+}
+
+func newEventSink(sinkType string) (EventSink, error) {
+	switch sinkType {
+	case "stdout":
+		return newStdoutSink(), nil
+	case "syslog":
+		return newSyslogSink(viper.GetString("event_streaming.sink.syslog.network"),
+			viper.GetString("event_streaming.sink.syslog.address"),
+			viper.GetInt("event_streaming.sink.syslog.facility")), nil
+	case "loki":
+		if viper.GetString("event_streaming.sink.loki.url") == "" {
+			return nil, fmt.Errorf("event_streaming.sink.loki.url must be set")
+		}
+		return newLokiSink(viper.GetString("event_streaming.sink.loki.url"),
+			viper.GetStringMapString("event_streaming.sink.loki.headers"),
+			viper.GetStringMapString("event_streaming.sink.loki.labels"),
+			viper.GetDuration("event_streaming.sink.loki.timeout")*time.Second), nil
+	}
+	return nil, fmt.Errorf("not supported event sink %s, must be stdout, syslog or loki", sinkType)
+}
+
+// Start a poll loop for every fabric and class, also for fabrics added by a reload. Only records created after the
+// start are forwarded.
+func (e *EventStreamer) Start() {
+	e.handler.startFabricLoops("event streaming", e.fabrics, e.run)
+}
+
+// run a poll loop for every class of the fabric until the context is done
+func (e *EventStreamer) run(ctx context.Context, fabricName string) {
+	var wg sync.WaitGroup
+	for _, class := range e.classes {
+		log.WithFields(log.Fields{
+			LogFieldFabric: fabricName,
+			"class":        class,
+			"interval":     e.interval.Seconds(),
+		}).Info("start event streaming")
+
+		poller := &eventPoller{
+			fabric:      fabricName,
+			class:       class,
+			lastCreated: time.Now(),
+			seen:        make(map[string]time.Time),
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.runPoller(ctx, poller)
+		}()
+	}
+	wg.Wait()
+}
+
+func (e *EventStreamer) runPoller(ctx context.Context, poller *eventPoller) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := e.poll(ctx, poller)
+		if err != nil && ctx.Err() == nil {
+			eventsFailedMetric.With(prometheus.Labels{LogFieldFabric: poller.fabric, "class": poller.class}).Inc()
+			log.WithFields(log.Fields{
+				LogFieldFabric: poller.fabric,
+				"class":        poller.class,
+			}).Warning("event streaming failed - ", err)
+		}
+	}
+}
+
+// poll fetch the records created since the last forwarded record and forward the ones not already forwarded
+func (e *EventStreamer) poll(ctx context.Context, poller *eventPoller) error {
+	ctx = context.WithValue(ctx, LogFieldRequestID, nextRequestID())
+	ctx = context.WithValue(ctx, LogFieldFabric, poller.fabric)
+
+	fabricConfig, ok := e.handler.fabric(poller.fabric)
+	if !ok {
+		return fmt.Errorf("fabric do not exists")
+	}
+
+	con := newAciConnection(fabricConfig, nil)
+	err := con.login(ctx)
+	if err != nil {
+		return err
+	}
+
+	filter := fmt.Sprintf("ge(%s.created,\"%s\")", poller.class, poller.lastCreated.Format(apicTimeFormat))
+	data, err := con.GetByClassQuery(ctx, poller.class, fmt.Sprintf("?order-by=%s.created&query-target-filter=%s",
+		poller.class, url.QueryEscape(filter)))
+	if err != nil {
+		return err
+	}
+
+	var events []Event
+	gjson.Get(data, fmt.Sprintf("imdata.#.%s.attributes", poller.class)).ForEach(func(key, value gjson.Result) bool {
+		event := Event{
+			Fabric:     poller.fabric,
+			Class:      poller.class,
+			Attributes: make(map[string]string),
+		}
+		value.ForEach(func(k, v gjson.Result) bool {
+			event.Attributes[k.String()] = v.String()
+			return true
+		})
+		event.ID = event.Attributes["id"]
+		created, parseErr := time.Parse(time.RFC3339, event.Attributes["created"])
+		if parseErr != nil {
+			log.WithFields(log.Fields{
+				LogFieldFabric: poller.fabric,
+				"class":        poller.class,
+				"created":      event.Attributes["created"],
+			}).Warning("not a valid created time")
+			return true
+		}
+		event.Created = created
+		if _, ok := poller.seen[event.ID]; ok || event.Created.Before(poller.lastCreated) {
+			return true
+		}
+		events = append(events, event)
+		return true
+	})
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Created.Before(events[j].Created)
+	})
+
+	// The records are only marked as forwarded if successful, else they are fetched again on next poll
+	err = e.sink.Send(ctx, events)
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		poller.seen[event.ID] = event.Created
+	}
+	poller.lastCreated = events[len(events)-1].Created
+	for id, created := range poller.seen {
+		if created.Before(poller.lastCreated) {
+			delete(poller.seen, id)
+		}
+	}
+
+	eventsForwardedMetric.With(prometheus.Labels{LogFieldFabric: poller.fabric, "class": poller.class}).
+		Add(float64(len(events)))
+	log.WithFields(log.Fields{
+		LogFieldRequestID: ctx.Value(LogFieldRequestID),
+		LogFieldFabric:    poller.fabric,
+		"class":           poller.class,
+		"events":          len(events),
+	}).Debug("events forwarded")
+	return nil
+}
+
+// toMap return the event as a flat map, the attributes of the record and the fabric and class
+func (e Event) toMap() map[string]string {
+	fields := make(map[string]string, len(e.Attributes)+2)
+	for k, v := range e.Attributes {
+		fields[k] = v
+	}
+	fields["fabric"] = e.Fabric
+	fields["class"] = e.Class
+	return fields
+}
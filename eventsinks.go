@@ -0,0 +1,191 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// stdoutSink write every event as a json line to stdout
+type stdoutSink struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+func newStdoutSink() *stdoutSink {
+	return &stdoutSink{encoder: json.NewEncoder(os.Stdout)}
+}
+
+func (s *stdoutSink) Send(ctx context.Context, events []Event) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, event := range events {
+		err := s.encoder.Encode(event.toMap())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syslogSink send every event as a RFC 5424 message, the message is the event as json. For tcp the messages are
+// framed by octet counting as in RFC 6587.
+type syslogSink struct {
+	network  string
+	address  string
+	facility int
+	hostname string
+	mutex    sync.Mutex
+	con      net.Conn
+}
+
+func newSyslogSink(network string, address string, facility int) *syslogSink {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+	return &syslogSink{
+		network:  network,
+		address:  address,
+		facility: facility,
+		hostname: hostname,
+	}
+}
+
+// syslogSeverity map the apic severity to the syslog severity
+func syslogSeverity(severity string) int {
+	switch severity {
+	case "critical":
+		return 2
+	case "major":
+		return 3
+	case "minor":
+		return 4
+	case "warning":
+		return 4
+	case "cleared":
+		return 5
+	}
+	// info and audit log records without severity
+	return 6
+}
+
+func (s *syslogSink) Send(ctx context.Context, events []Event) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.con == nil {
+		con, err := net.DialTimeout(s.network, s.address, 10*time.Second)
+		if err != nil {
+			return err
+		}
+		s.con = con
+	}
+
+	for _, event := range events {
+		msg, err := json.Marshal(event.toMap())
+		if err != nil {
+			return err
+		}
+		// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+		line := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s", s.facility*8+syslogSeverity(event.Attributes["severity"]),
+			event.Created.Format(time.RFC3339Nano), s.hostname, ExporterName, os.Getpid(), event.Class, msg)
+		if s.network != "udp" {
+			line = strconv.Itoa(len(line)) + " " + line
+		}
+
+		_, err = s.con.Write([]byte(line))
+		if err != nil {
+			// Reconnect on next send
+			_ = s.con.Close()
+			s.con = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// lokiSink push the events to the Loki push api, the events are labeled by fabric and class and the configured labels
+type lokiSink struct {
+	url     string
+	headers map[string]string
+	labels  map[string]string
+	client  *http.Client
+}
+
+func newLokiSink(url string, headers map[string]string, labels map[string]string, timeout time.Duration) *lokiSink {
+	return &lokiSink{
+		url:     url,
+		headers: headers,
+		labels:  labels,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func (l *lokiSink) Send(ctx context.Context, events []Event) error {
+	// All events in a send are of the same fabric and class
+	stream := lokiStream{Stream: map[string]string{}}
+	for k, v := range l.labels {
+		stream.Stream[k] = v
+	}
+	stream.Stream["fabric"] = events[0].Fabric
+	stream.Stream["class"] = events[0].Class
+
+	for _, event := range events {
+		line, err := json.Marshal(event.toMap())
+		if err != nil {
+			return err
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(event.Created.UnixNano(), 10), string(line)})
+	}
+
+	body, err := json.Marshal(map[string][]lokiStream{"streams": {stream}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", l.url, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range l.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("loki returned %d", resp.StatusCode)
+	}
+	return nil
+}
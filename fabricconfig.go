@@ -11,11 +11,94 @@
 
 package main
 
+import "net/http"
+
 type Fabric struct {
-	Username        string                 `mapstructure:"username"`
-	Password        string                 `mapstructure:"password"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// UsernameFile and PasswordFile are read on every login and override username and password
+	UsernameFile string `mapstructure:"username_file"`
+	PasswordFile string `mapstructure:"password_file"`
+	// Secret read the username and password from a secret provider
+	Secret FabricSecret `mapstructure:"secret"`
+	// PrivateKeyFile and CertificateDN enable certificate based authentication, e.g. the DN
+	// uni/userext/user-<username>/usercert-<certificate name>
+	PrivateKeyFile  string                 `mapstructure:"private_key_file"`
+	CertificateDN   string                 `mapstructure:"certificate_dn"`
 	Apic            []string               `mapstructure:"apic"`
 	AciName         string                 `mapstructure:"aci_name"`
 	FabricName      string                 `mapstructure:"fabric_name"`
 	DiscoveryConfig DiscoveryConfiguration `mapstructure:"service_discovery"`
+	// CollectionInterval override the background collection and otlp push interval in seconds for the fabric
+	CollectionInterval int `mapstructure:"collection_interval"`
+	// TLS settings for the connections to the apic and nodes of the fabric
+	TLS FabricTLS `mapstructure:"tls"`
+	// ProxyURL is the http proxy used for the connections to the fabric
+	ProxyURL string `mapstructure:"proxy_url"`
+	// Limits of all queries of the fabric, override the global limits
+	Limits QueryLimits `mapstructure:"limits"`
+	// MaxInflightRequests override httpclient.max_inflight_requests for the fabric
+	MaxInflightRequests int `mapstructure:"max_inflight_requests"`
+	// apicClient and nodeClient are created when the configuration is loaded, so the TLS files are only read and
+	// validated on load and reload
+	apicClient *http.Client
+	nodeClient *http.Client
+}
+
+// newHTTPClients create the http clients of the apic and the nodes, an error if the TLS settings are not valid
+func (f *Fabric) newHTTPClients() error {
+	apicClient, err := newFabricHTTPClient(f, nil)
+	if err != nil {
+		return err
+	}
+	node := ""
+	nodeClient, err := newFabricHTTPClient(f, &node)
+	if err != nil {
+		return err
+	}
+	f.apicClient = apicClient
+	f.nodeClient = nodeClient
+	return nil
+}
+
+// httpClient return a copy of the http client of the apic, or the nodes. The client is created if the fabric is not
+// loaded from the configuration.
+func (f *Fabric) httpClient(node *string) (http.Client, error) {
+	client := f.apicClient
+	if node != nil {
+		client = f.nodeClient
+	}
+	if client == nil {
+		var err error
+		client, err = newFabricHTTPClient(f, node)
+		if err != nil {
+			return http.Client{}, err
+		}
+	}
+	return *client, nil
+}
+
+// FabricTLS define the trusted CAs, the client certificate and the TLS version used for a fabric
+type FabricTLS struct {
+	// CAFile and CADirectory are PEM encoded CA certificates added to the system CAs
+	CAFile      string `mapstructure:"ca_file"`
+	CADirectory string `mapstructure:"ca_directory"`
+	// ServerName override the name used to verify the certificate of the apic
+	ServerName string `mapstructure:"server_name"`
+	// MinVersion is 1.0, 1.1, 1.2 or 1.3
+	MinVersion string `mapstructure:"min_version"`
+	CertFile   string `mapstructure:"cert_file"`
+	KeyFile    string `mapstructure:"key_file"`
+	// InsecureSkipVerify override httpclient.insecureHTTPS for the fabric
+	InsecureSkipVerify *bool `mapstructure:"insecure_skip_verify"`
+}
+
+// FabricSecret define the secret, and the keys of the username and password in the secret, of a secret provider
+type FabricSecret struct {
+	// Provider is vault or kubernetes
+	Provider string `mapstructure:"provider"`
+	// Path is the vault api path, like secret/data/aci/fabric, or the directory of the mounted kubernetes secret
+	Path        string `mapstructure:"path"`
+	UsernameKey string `mapstructure:"username_key"`
+	PasswordKey string `mapstructure:"password_key"`
 }
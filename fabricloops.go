@@ -0,0 +1,111 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FabricLoops run a background loop for every fabric. The loops are started for fabrics added by a configuration
+// reload, stopped for removed fabrics and restarted for changed fabrics.
+type FabricLoops struct {
+	handler *HandlerInit
+	name    string
+	// fabrics is the configured fabrics, if empty a loop is run for all fabrics
+	fabrics []string
+	loop    func(ctx context.Context, fabricName string)
+	running map[string]context.CancelFunc
+	mutex   sync.Mutex
+}
+
+// startFabricLoops start the loop for the fabrics and register the loops to be synced on reload
+func (h *HandlerInit) startFabricLoops(name string, fabrics []string, loop func(ctx context.Context, fabricName string)) {
+	loops := &FabricLoops{
+		handler: h,
+		name:    name,
+		fabrics: fabrics,
+		loop:    loop,
+		running: make(map[string]context.CancelFunc),
+	}
+
+	h.configMutex.Lock()
+	h.fabricLoops = append(h.fabricLoops, loops)
+	h.configMutex.Unlock()
+
+	loops.sync(nil)
+}
+
+// syncFabricLoops start and stop the loops after a reload, the loops of the changed fabrics are restarted
+func (h *HandlerInit) syncFabricLoops(changed []string) {
+	h.configMutex.RLock()
+	fabricLoops := h.fabricLoops
+	h.configMutex.RUnlock()
+
+	for _, loops := range fabricLoops {
+		loops.sync(changed)
+	}
+}
+
+func (l *FabricLoops) sync(changed []string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	fabrics := make(map[string]bool)
+	if len(l.fabrics) == 0 {
+		for fabricName := range l.handler.fabrics() {
+			fabrics[fabricName] = true
+		}
+	} else {
+		for _, fabricName := range l.fabrics {
+			if _, ok := l.handler.fabric(fabricName); !ok {
+				log.WithFields(log.Fields{
+					LogFieldFabric: fabricName,
+				}).Warning(l.name + " fabric do not exists")
+				continue
+			}
+			fabrics[fabricName] = true
+		}
+	}
+
+	for _, fabricName := range changed {
+		if cancel, ok := l.running[fabricName]; ok {
+			cancel()
+			delete(l.running, fabricName)
+		}
+	}
+
+	for fabricName, cancel := range l.running {
+		if !fabrics[fabricName] {
+			log.WithFields(log.Fields{
+				LogFieldFabric: fabricName,
+			}).Info("stop " + l.name)
+			cancel()
+			delete(l.running, fabricName)
+		}
+	}
+
+	for fabricName := range fabrics {
+		if _, ok := l.running[fabricName]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(l.handler.ctx)
+		fabricName := fabricName
+		if !l.handler.startLoop(func(context.Context) { l.loop(ctx, fabricName) }) {
+			cancel()
+			return
+		}
+		l.running[fabricName] = cancel
+	}
+}
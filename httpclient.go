@@ -14,42 +14,147 @@ package main
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"time"
 )
 
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
 // HTTPClient used for retrieve data from an HTTP based api
 type HTTPClient struct {
 	InsecureHTTPS       bool
 	Timeout             int
 	Keepalive           int
 	Tlshandshaketimeout int
+	TLS                 FabricTLS
+	ProxyURL            string
 }
 
 // GetClient return a http client
-func (c HTTPClient) GetClient() *http.Client {
-
-	rootCAs, _ := x509.SystemCertPool()
-	if rootCAs == nil {
-		rootCAs = x509.NewCertPool()
-	}
-
-	var client = &http.Client{
-		Timeout: time.Duration(c.Timeout) * time.Second,
-		Transport: &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout:   time.Duration(c.Timeout) * time.Second,
-				KeepAlive: time.Duration(c.Keepalive) * time.Second,
-			}).DialContext,
-			//TLSHandshakeTimeout: time.Duration(c.Tlshandshaketimeout) * time.Second,
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: c.InsecureHTTPS,
-				//RootCAs:            rootCAs,
-			},
-			//ExpectContinueTimeout: 4 * time.Second,
-			//ResponseHeaderTimeout: 3 * time.Second,
-		},
-	}
-	return client
+func (c HTTPClient) GetClient() (*http.Client, error) {
+	tlsConfig, err := c.TLS.tlsConfig(c.InsecureHTTPS)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   time.Duration(c.Timeout) * time.Second,
+			KeepAlive: time.Duration(c.Keepalive) * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: time.Duration(c.Tlshandshaketimeout) * time.Second,
+		TLSClientConfig:     tlsConfig,
+	}
+
+	if c.ProxyURL != "" {
+		proxyURL, err := url.Parse(c.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("proxy_url %s is not valid - %s", c.ProxyURL, err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Client{
+		Timeout:   time.Duration(c.Timeout) * time.Second,
+		Transport: transport,
+	}, nil
+}
+
+// tlsConfig create the tls configuration. If a CA or server name is configured the certificate is verified, unless
+// insecure_skip_verify is set, else the global insecureHTTPS is used.
+func (t FabricTLS) tlsConfig(insecureHTTPS bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: insecureHTTPS,
+		ServerName:         t.ServerName,
+	}
+	if t.CAFile != "" || t.CADirectory != "" || t.ServerName != "" {
+		tlsConfig.InsecureSkipVerify = false
+	}
+	if t.InsecureSkipVerify != nil {
+		tlsConfig.InsecureSkipVerify = *t.InsecureSkipVerify
+	}
+
+	if t.MinVersion != "" {
+		version, ok := tlsVersions[t.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("min_version %s is not valid, must be 1.0, 1.1, 1.2 or 1.3", t.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if t.CAFile != "" || t.CADirectory != "" {
+		rootCAs, _ := x509.SystemCertPool()
+		if rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if t.CAFile != "" {
+			err := appendCAFile(rootCAs, t.CAFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if t.CADirectory != "" {
+			err := appendCADirectory(rootCAs, t.CADirectory)
+			if err != nil {
+				return nil, err
+			}
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if t.CertFile != "" || t.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate not valid - %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+func appendCAFile(rootCAs *x509.CertPool, caFile string) error {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("ca_file not readable - %s", err)
+	}
+	if !rootCAs.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("ca_file %s has no valid certificates", caFile)
+	}
+	return nil
+}
+
+// appendCADirectory add the certificates of all files in the directory, files without certificates are ignored
+func appendCADirectory(rootCAs *x509.CertPool, caDirectory string) error {
+	entries, err := os.ReadDir(caDirectory)
+	if err != nil {
+		return fmt.Errorf("ca_directory not readable - %s", err)
+	}
+	found := false
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		pem, err := os.ReadFile(filepath.Join(caDirectory, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("ca_directory not readable - %s", err)
+		}
+		if rootCAs.AppendCertsFromPEM(pem) {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("ca_directory %s has no valid certificates", caDirectory)
+	}
+	return nil
 }
@@ -0,0 +1,165 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
+)
+
+// joinCache keep the objects of the join class queries, by fabric or node, class, query parameter and join property,
+// for the ttl
+var joinCache = struct {
+	sync.Mutex
+	entries map[string]*joinCacheEntry
+}{entries: make(map[string]*joinCacheEntry)}
+
+type joinCacheEntry struct {
+	mutex   sync.Mutex
+	index   map[string]string
+	expires time.Time
+}
+
+// joinTable is the objects of a join class query indexed by the join key
+type joinTable struct {
+	join  ConfigJoin
+	index map[string]string
+}
+
+// ttl return the time the objects of the join are cached
+func (j ConfigJoin) ttl() time.Duration {
+	if j.TTL > 0 {
+		return time.Duration(j.TTL) * time.Second
+	}
+	return viper.GetDuration("join_cache.ttl") * time.Second
+}
+
+// joinPropertyName return the property of the joined objects with the key, default the dn
+func (j ConfigJoin) joinPropertyName() string {
+	if j.JoinPropertyName != "" {
+		return j.JoinPropertyName
+	}
+	return j.ClassName + ".attributes.dn"
+}
+
+// joinTables return the tables of the joins of the query, from the cache or the apic. A join that fail is logged and
+// not included, so the metrics of the query are still returned but without the labels of the join.
+func (p aciAPI) joinTables(joins []ConfigJoin) []joinTable {
+	if len(joins) == 0 || p.connection == nil {
+		return nil
+	}
+
+	var tables []joinTable
+	for _, join := range joins {
+		index, err := p.joinIndex(join)
+		if err != nil {
+			log.WithFields(log.Fields{
+				LogFieldRequestID: p.ctx.Value(LogFieldRequestID),
+				LogFieldFabric:    fmt.Sprintf("%v", p.ctx.Value(LogFieldFabric)),
+				"class":           join.ClassName,
+			}).Warning("join query failed - ", err)
+			continue
+		}
+		tables = append(tables, joinTable{join: join, index: index})
+	}
+	return tables
+}
+
+// joinIndex return the objects of the join class query by the join key. The entry is locked during the request so
+// queries joining the same class at the same time share the request.
+func (p aciAPI) joinIndex(join ConfigJoin) (map[string]string, error) {
+	key := fmt.Sprintf("%s/%s%s/%s", cacheName(p.connection.fabricConfig.FabricName, p.connection.Node),
+		join.ClassName, join.QueryParameter, join.joinPropertyName())
+
+	joinCache.Lock()
+	entry, ok := joinCache.entries[key]
+	if !ok {
+		entry = &joinCacheEntry{}
+		joinCache.entries[key] = entry
+	}
+	now := time.Now()
+	for otherKey, other := range joinCache.entries {
+		// An entry that is locked is being requested and not expired
+		if other == entry || !other.mutex.TryLock() {
+			continue
+		}
+		if other.index != nil && now.After(other.expires) {
+			delete(joinCache.entries, otherKey)
+		}
+		other.mutex.Unlock()
+	}
+	joinCache.Unlock()
+
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+	if entry.index != nil && time.Now().Before(entry.expires) {
+		return entry.index, nil
+	}
+
+	// The join is not part of the limits of the query
+	ctx := context.WithValue(p.ctx, ContextKeyLimits, (*limitState)(nil))
+	data, err := p.connection.GetByClassQuery(ctx, join.ClassName, join.QueryParameter)
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[string]string)
+	joinPropertyName := join.joinPropertyName()
+	gjson.Get(data, "imdata").ForEach(func(_, value gjson.Result) bool {
+		index[gjson.Get(value.Raw, joinPropertyName).String()] = value.Raw
+		return true
+	})
+
+	entry.index = index
+	entry.expires = time.Now().Add(join.ttl())
+	return index, nil
+}
+
+// lookup return the joined object of the object of the class. With a property_name the value of the property is the
+// key, else the object with the longest dn that is a prefix of the dn of the object.
+func (t joinTable) lookup(className string, object string) (string, bool) {
+	if t.join.PropertyName != "" {
+		joined, ok := t.index[gjson.Get(object, t.join.PropertyName).String()]
+		return joined, ok
+	}
+
+	dn := gjson.Get(object, className+".attributes.dn").String()
+	for dn != "" {
+		if joined, ok := t.index[dn]; ok {
+			return joined, true
+		}
+		i := strings.LastIndex(dn, "/")
+		if i < 0 {
+			break
+		}
+		dn = dn[:i]
+	}
+	return "", false
+}
+
+// addJoinLabels add the labels of the joined objects to the metric of the object
+func addJoinLabels(tables []joinTable, className string, object string, metric Metric) {
+	for _, table := range tables {
+		joined, ok := table.lookup(className, object)
+		if !ok {
+			continue
+		}
+		addLabels(table.join.Labels, nil, joined, metric)
+	}
+}
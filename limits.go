@@ -0,0 +1,243 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	LimitMaxSeries        = "max_series"
+	LimitMaxResponseBytes = "max_response_bytes"
+	LimitMaxPages         = "max_pages"
+
+	// LimitActionTruncate keep the series, or pages, up to the limit
+	LimitActionTruncate = "truncate"
+	// LimitActionDrop drop all series of the query
+	LimitActionDrop = "drop"
+	// LimitActionFail drop all series of the query and fail the scrape
+	LimitActionFail = "fail"
+
+	// ContextKeyLimits is the context key of the limits of the executing query
+	ContextKeyLimits = "limits"
+)
+
+var validLimitActions = map[string]bool{
+	LimitActionTruncate: true,
+	LimitActionDrop:     true,
+	LimitActionFail:     true,
+}
+
+// QueryLimits limit the size of a query, a limit of 0 is not set
+type QueryLimits struct {
+	MaxSeries        int    `mapstructure:"max_series" yaml:"max_series"`
+	MaxResponseBytes int    `mapstructure:"max_response_bytes" yaml:"max_response_bytes"`
+	MaxPages         int    `mapstructure:"max_pages" yaml:"max_pages"`
+	Action           string `mapstructure:"action" yaml:"action"`
+}
+
+// merge return the limits where the limits not set are taken from defaults
+func (l QueryLimits) merge(defaults QueryLimits) QueryLimits {
+	if l.MaxSeries == 0 {
+		l.MaxSeries = defaults.MaxSeries
+	}
+	if l.MaxResponseBytes == 0 {
+		l.MaxResponseBytes = defaults.MaxResponseBytes
+	}
+	if l.MaxPages == 0 {
+		l.MaxPages = defaults.MaxPages
+	}
+	if l.Action == "" {
+		l.Action = defaults.Action
+	}
+	return l
+}
+
+// validate the action of the limits
+func (l QueryLimits) validate() error {
+	if l.Action != "" && !validLimitActions[l.Action] {
+		return fmt.Errorf("limits action %s is not valid, must be truncate, drop or fail", l.Action)
+	}
+	return nil
+}
+
+// globalLimits return the limits of the limits configuration that apply to all fabrics and queries
+func globalLimits() QueryLimits {
+	return configLimits(viper.GetViper())
+}
+
+// configLimits return the limits of the limits configuration of the viper instance
+func configLimits(v *viper.Viper) QueryLimits {
+	return QueryLimits{
+		MaxSeries:        v.GetInt("limits.max_series"),
+		MaxResponseBytes: v.GetInt("limits.max_response_bytes"),
+		MaxPages:         v.GetInt("limits.max_pages"),
+		Action:           v.GetString("limits.action"),
+	}
+}
+
+// LimitExceededError is returned when a query exceed a limit and the query is dropped
+type LimitExceededError struct {
+	Limit  string
+	Max    int
+	Action string
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("query limit %s %d exceeded", e.Limit, e.Max)
+}
+
+// limitState is the limits of a query and the limits exceeded during the execution of the query. The state is
+// shared by all requests of the query by the context, a nil state has no limits.
+type limitState struct {
+	limits   QueryLimits
+	mutex    sync.Mutex
+	bytes    int
+	exceeded map[string]bool
+}
+
+func newLimitState(limits QueryLimits) *limitState {
+	return &limitState{
+		limits:   limits,
+		exceeded: make(map[string]bool),
+	}
+}
+
+// limitStateFromContext return the limit state of the query executing in the context, or nil if none
+func limitStateFromContext(ctx context.Context) *limitState {
+	state, _ := ctx.Value(ContextKeyLimits).(*limitState)
+	return state
+}
+
+// exceed record that the limit is exceeded
+func (s *limitState) exceed(limit string, max int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.exceeded[limit] = true
+	return &LimitExceededError{Limit: limit, Max: max, Action: s.limits.Action}
+}
+
+// exceededLimits return the names of the exceeded limits
+func (s *limitState) exceededLimits() []string {
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	limits := make([]string, 0, len(s.exceeded))
+	for limit := range s.exceeded {
+		limits = append(limits, limit)
+	}
+	sort.Strings(limits)
+	return limits
+}
+
+// failed is true if a limit is exceeded and the action is fail
+func (s *limitState) failed() bool {
+	return s != nil && s.limits.Action == LimitActionFail && len(s.exceededLimits()) > 0
+}
+
+// readBody read the response body. The size of all responses of the query is limited by max_response_bytes, a
+// response can not be truncated so the query is dropped independent of the action.
+func (s *limitState) readBody(body io.Reader) ([]byte, error) {
+	if s == nil || s.limits.MaxResponseBytes <= 0 {
+		return io.ReadAll(body)
+	}
+
+	s.mutex.Lock()
+	remaining := s.limits.MaxResponseBytes - s.bytes
+	s.mutex.Unlock()
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	bodyBytes, err := io.ReadAll(io.LimitReader(body, int64(remaining)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	s.bytes = s.bytes + len(bodyBytes)
+	exceeded := s.bytes > s.limits.MaxResponseBytes
+	s.mutex.Unlock()
+	if exceeded {
+		return nil, s.exceed(LimitMaxResponseBytes, s.limits.MaxResponseBytes)
+	}
+	return bodyBytes, nil
+}
+
+// responseBytesExceeded return an error if max_response_bytes has been exceeded by any response of the query
+func (s *limitState) responseBytesExceeded() error {
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.exceeded[LimitMaxResponseBytes] {
+		return &LimitExceededError{Limit: LimitMaxResponseBytes, Max: s.limits.MaxResponseBytes, Action: s.limits.Action}
+	}
+	return nil
+}
+
+// pages return the number of pages to fetch of the total number of pages. If max_pages is exceeded only the max
+// number of pages are fetched if the action is truncate, else no more pages are fetched.
+func (s *limitState) pages(total int) (int, error) {
+	if s == nil || s.limits.MaxPages <= 0 || total <= s.limits.MaxPages {
+		return total, nil
+	}
+	err := s.exceed(LimitMaxPages, s.limits.MaxPages)
+	if s.limits.Action == LimitActionTruncate {
+		return s.limits.MaxPages, nil
+	}
+	return 0, err
+}
+
+// series apply max_series to the metrics of the query. If exceeded the first max series are kept if the action is
+// truncate, else all series of the query are dropped.
+func (s *limitState) series(metricDefinitions []MetricDefinition) ([]MetricDefinition, error) {
+	if s == nil || s.limits.MaxSeries <= 0 {
+		return metricDefinitions, nil
+	}
+
+	count := 0
+	for _, metricDefinition := range metricDefinitions {
+		count = count + len(metricDefinition.Metrics)
+	}
+	if count <= s.limits.MaxSeries {
+		return metricDefinitions, nil
+	}
+
+	err := s.exceed(LimitMaxSeries, s.limits.MaxSeries)
+	if s.limits.Action != LimitActionTruncate {
+		return nil, err
+	}
+
+	var truncated []MetricDefinition
+	remaining := s.limits.MaxSeries
+	for _, metricDefinition := range metricDefinitions {
+		if remaining == 0 {
+			break
+		}
+		if len(metricDefinition.Metrics) > remaining {
+			metricDefinition.Metrics = metricDefinition.Metrics[:remaining]
+		}
+		remaining = remaining - len(metricDefinition.Metrics)
+		truncated = append(truncated, metricDefinition)
+	}
+	return truncated, nil
+}
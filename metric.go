@@ -13,13 +13,22 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// Metric types that are not a single value of the value_name property
+const (
+	MetricTypeHistogram = "histogram"
+	MetricTypeSummary   = "summary"
+	MetricTypeInfo      = "info"
+)
+
 type MetricDefinition struct {
 	Name        string // the name of the metrics
 	Metrics     []Metric
@@ -31,6 +40,16 @@ type Metric struct {
 	Value     float64
 	Labels    map[string]string
 	Timestamp float64
+	// Distribution is only set for histogram and summary metrics
+	Distribution *Distribution
+}
+
+// Distribution the cumulative buckets of a histogram, by upper bound, or the quantiles of a summary
+type Distribution struct {
+	Buckets   map[float64]float64
+	Quantiles map[float64]float64
+	Sum       float64
+	Count     float64
 }
 
 // MetricDesc the Prometheus help and type text
@@ -71,15 +90,19 @@ func toSnakeCase(str string) string {
 
 // Labels2Prometheus create a string of all labels, sorted by label name
 func (m Metric) Labels2Prometheus(commonLabels map[string]string, format MetricFormat) string {
-	// append all common maps
+	// append all common maps, the metric labels are not modified since the metric may be shared between requests
+	labels := make(map[string]string, len(m.Labels)+len(commonLabels))
+	for k, v := range m.Labels {
+		labels[k] = v
+	}
 	if len(commonLabels) != 0 {
 		for k, v := range commonLabels {
-			m.Labels[toLowerLabels(k, format)] = v
+			labels[toLowerLabels(k, format)] = v
 		}
 	}
 
-	keys := make([]string, 0, len(m.Labels))
-	for k := range m.Labels {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
 		keys = append(keys, k)
 	}
 
@@ -89,8 +112,8 @@ func (m Metric) Labels2Prometheus(commonLabels map[string]string, format MetricF
 	sep := ""
 	for _, k := range keys {
 		// Filter out empty labels
-		if m.Labels[k] != "" {
-			addText(&builder, fmt.Sprintf("%s%s=\"%s\"", sep, toLowerLabels(k, format), m.Labels[k]))
+		if labels[k] != "" {
+			addText(&builder, fmt.Sprintf("%s%s=\"%s\"", sep, toLowerLabels(k, format), labels[k]))
 			sep = ","
 		}
 	}
@@ -105,7 +128,12 @@ func Metrics2Prometheus(metrics []MetricDefinition, prefix string, commonLabels
 
 		// only format if the metrics slice include items
 		metricName := metricDefinition.Name
-		if metricDefinition.Description.Unit != "" {
+		if metricDefinition.Description.Type == MetricTypeInfo {
+			// An info metric has no unit and the name must end with _info
+			if !strings.HasSuffix(metricName, "_info") {
+				metricName = metricName + "_info"
+			}
+		} else if metricDefinition.Description.Unit != "" {
 			metricName = metricDefinition.Name + "_" + metricDefinition.Description.Unit
 		}
 
@@ -121,7 +149,7 @@ func Metrics2Prometheus(metrics []MetricDefinition, prefix string, commonLabels
 			}
 
 			promType := "gauge"
-			if metricDefinition.Description.Type != "" {
+			if metricDefinition.Description.Type != "" && metricDefinition.Description.Type != MetricTypeInfo {
 				promType = metricDefinition.Description.Type
 			}
 			if format.openmetrics {
@@ -130,12 +158,18 @@ func Metrics2Prometheus(metrics []MetricDefinition, prefix string, commonLabels
 				} else {
 					addText(&builder, fmt.Sprintf("# TYPE %s%s %s\n", prefix, metricName, promType))
 				}
-				addText(&builder, fmt.Sprintf("# UNIT %s%s %s\n", prefix, metricName, metricDefinition.Description.Unit))
+				if metricDefinition.Description.Type != MetricTypeInfo {
+					addText(&builder, fmt.Sprintf("# UNIT %s%s %s\n", prefix, metricName, metricDefinition.Description.Unit))
+				}
 			} else {
 				addText(&builder, fmt.Sprintf("# TYPE %s%s %s\n", prefix, metricName, promType))
 			}
 
 			for _, metric := range metricDefinition.Metrics {
+				if metric.Distribution != nil {
+					addDistribution(&builder, prefix+metricName, metric, commonLabels, format)
+					continue
+				}
 				addText(&builder, fmt.Sprintf("%s%s{%s} %g\n", prefix, metricName, metric.Labels2Prometheus(commonLabels, format), metric.Value))
 			}
 		}
@@ -146,6 +180,52 @@ func Metrics2Prometheus(metrics []MetricDefinition, prefix string, commonLabels
 	return builder.String()
 }
 
+// addDistribution add the _bucket or quantile series and the _sum and _count series of a histogram or summary
+func addDistribution(builder *strings.Builder, name string, metric Metric, commonLabels map[string]string, format MetricFormat) {
+	labels := metric.Labels2Prometheus(commonLabels, format)
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+
+	if metric.Distribution.Buckets != nil {
+		upperBounds := make([]float64, 0, len(metric.Distribution.Buckets))
+		for upperBound := range metric.Distribution.Buckets {
+			upperBounds = append(upperBounds, upperBound)
+		}
+		sort.Float64s(upperBounds)
+		for _, upperBound := range upperBounds {
+			addText(builder, fmt.Sprintf("%s_bucket{%s%sle=\"%s\"} %g\n", name, labels, sep,
+				formatFloatLabel(upperBound, format), metric.Distribution.Buckets[upperBound]))
+		}
+	} else {
+		quantiles := make([]float64, 0, len(metric.Distribution.Quantiles))
+		for quantile := range metric.Distribution.Quantiles {
+			quantiles = append(quantiles, quantile)
+		}
+		sort.Float64s(quantiles)
+		for _, quantile := range quantiles {
+			addText(builder, fmt.Sprintf("%s{%s%squantile=\"%s\"} %g\n", name, labels, sep,
+				formatFloatLabel(quantile, format), metric.Distribution.Quantiles[quantile]))
+		}
+	}
+
+	addText(builder, fmt.Sprintf("%s_sum{%s} %g\n", name, labels, metric.Distribution.Sum))
+	addText(builder, fmt.Sprintf("%s_count{%s} %g\n", name, labels, metric.Distribution.Count))
+}
+
+// formatFloatLabel format the le and quantile label values, openmetrics require the canonical format like 1.0 and +Inf
+func formatFloatLabel(value float64, format MetricFormat) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	text := strconv.FormatFloat(value, 'g', -1, 64)
+	if format.openmetrics && !strings.ContainsAny(text, ".eE") {
+		text = text + ".0"
+	}
+	return text
+}
+
 func addText(builder *strings.Builder, text string) {
 	_, err := builder.WriteString(text)
 	if err != nil {
@@ -0,0 +1,239 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	NodeLabelName   = "node_name"
+	NodeLabelRole   = "role"
+	NodeLabelModel  = "model"
+	NodeLabelSerial = "serial"
+)
+
+// nodeLabels is the labels a node join can add, in the default order
+var nodeLabels = []string{NodeLabelName, NodeLabelRole, NodeLabelModel, NodeLabelSerial}
+
+// nodeCache is set if the node cache is enabled, queries with a node join get the node labels from the cache
+var nodeCache *NodeCache
+
+var nodeCacheNodesMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: MetricsPrefix + "node_cache_nodes",
+	Help: "Number of nodes in the node cache",
+},
+	[]string{"fabric"},
+)
+
+var nodeCacheFailedMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: MetricsPrefix + "node_cache_refresh_failed",
+	Help: "Number of failed node cache refreshes",
+},
+	[]string{"fabric"},
+)
+
+// NodeInfo is the name, role, model and serial of a node
+type NodeInfo struct {
+	ID     string
+	Name   string
+	Role   string
+	Model  string
+	Serial string
+}
+
+// label return the value of the node label
+func (n NodeInfo) label(labelName string) string {
+	switch labelName {
+	case NodeLabelName:
+		return n.Name
+	case NodeLabelRole:
+		return n.Role
+	case NodeLabelModel:
+		return n.Model
+	case NodeLabelSerial:
+		return n.Serial
+	}
+	return ""
+}
+
+// NodeCache keep the nodes of every fabric, by node id, from fabricNode and topSystem. The cache is refreshed on the
+// interval so joins do not need any apic calls during a scrape.
+type NodeCache struct {
+	handler  *HandlerInit
+	interval time.Duration
+
+	mutex sync.RWMutex
+	nodes map[string]map[string]NodeInfo
+}
+
+// StartNodeCache create the node cache and refresh all fabrics on the interval
+func StartNodeCache(handler *HandlerInit) {
+	nodeCache = &NodeCache{
+		handler:  handler,
+		interval: viper.GetDuration("node_cache.refresh_interval") * time.Second,
+		nodes:    make(map[string]map[string]NodeInfo),
+	}
+	log.WithFields(log.Fields{
+		"refresh_interval": nodeCache.interval.Seconds(),
+	}).Info("start node cache")
+
+	handler.startLoop(nodeCache.run)
+}
+
+func (n *NodeCache) run(ctx context.Context) {
+	ticker := time.NewTicker(n.interval)
+	defer ticker.Stop()
+
+	for {
+		n.refreshAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshAll refresh the configured fabrics, fabrics removed by a reload are removed from the cache
+func (n *NodeCache) refreshAll(ctx context.Context) {
+	fabrics := n.handler.fabrics()
+
+	var wg sync.WaitGroup
+	for fabricName := range fabrics {
+		wg.Add(1)
+		go func(fabricName string) {
+			defer wg.Done()
+			err := n.refresh(ctx, fabricName)
+			if err != nil && ctx.Err() == nil {
+				nodeCacheFailedMetric.With(prometheus.Labels{LogFieldFabric: fabricName}).Inc()
+				log.WithFields(log.Fields{
+					LogFieldFabric: fabricName,
+				}).Warning("node cache refresh failed - ", err)
+			}
+		}(fabricName)
+	}
+	wg.Wait()
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for fabricName := range n.nodes {
+		if _, ok := fabrics[fabricName]; !ok {
+			delete(n.nodes, fabricName)
+			nodeCacheNodesMetric.DeleteLabelValues(fabricName)
+		}
+	}
+}
+
+// refresh the nodes of the fabric. The model is only in fabricNode, and topSystem is only returned for active nodes,
+// so the nodes of fabricNode are updated with topSystem.
+func (n *NodeCache) refresh(ctx context.Context, fabricName string) error {
+	ctx = context.WithValue(ctx, LogFieldRequestID, nextRequestID())
+	ctx = context.WithValue(ctx, LogFieldFabric, fabricName)
+
+	fabricConfig, ok := n.handler.fabric(fabricName)
+	if !ok {
+		return fmt.Errorf("fabric do not exists")
+	}
+
+	con := newAciConnection(fabricConfig, nil)
+	err := con.login(ctx)
+	if err != nil {
+		return err
+	}
+
+	data, err := con.GetByClassQuery(ctx, "fabricNode", "")
+	if err != nil {
+		return err
+	}
+	nodes := make(map[string]NodeInfo)
+	gjson.Get(data, "imdata.#.fabricNode.attributes").ForEach(func(key, value gjson.Result) bool {
+		node := NodeInfo{
+			ID:     value.Get("id").String(),
+			Name:   value.Get("name").String(),
+			Role:   value.Get("role").String(),
+			Model:  value.Get("model").String(),
+			Serial: value.Get("serial").String(),
+		}
+		nodes[node.ID] = node
+		return true
+	})
+
+	data, err = con.GetByClassQuery(ctx, "topSystem", "")
+	if err != nil {
+		return err
+	}
+	gjson.Get(data, "imdata.#.topSystem.attributes").ForEach(func(key, value gjson.Result) bool {
+		topSystem := TopSystem{}
+		_ = json.Unmarshal([]byte(value.Raw), &topSystem)
+		node := nodes[topSystem.ID]
+		node.ID = topSystem.ID
+		node.Name = topSystem.Name
+		node.Role = topSystem.Role
+		node.Serial = topSystem.Serial
+		nodes[node.ID] = node
+		return true
+	})
+
+	n.mutex.Lock()
+	n.nodes[fabricName] = nodes
+	n.mutex.Unlock()
+	nodeCacheNodesMetric.With(prometheus.Labels{LogFieldFabric: fabricName}).Set(float64(len(nodes)))
+
+	log.WithFields(log.Fields{
+		LogFieldRequestID: ctx.Value(LogFieldRequestID),
+		LogFieldFabric:    fabricName,
+		"nodes":           len(nodes),
+	}).Debug("node cache refreshed")
+	return nil
+}
+
+// node return the node of the fabric by node id
+func (n *NodeCache) node(fabricName string, nodeID string) (NodeInfo, bool) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	node, ok := n.nodes[fabricName][nodeID]
+	return node, ok
+}
+
+// join add the node labels to the metrics with a node id label of a node in the cache. A label already set by the
+// query, like a role from the dn, is kept and not overwritten by the node label.
+func (n *NodeCache) join(fabricName string, metrics []Metric, nodeJoin *ConfigNodeJoin) []Metric {
+	if n == nil || nodeJoin == nil {
+		return metrics
+	}
+
+	nodeIDLabel, labelNames := nodeJoin.labels()
+	for _, metric := range metrics {
+		node, ok := n.node(fabricName, metric.Labels[nodeIDLabel])
+		if !ok {
+			continue
+		}
+		for _, labelName := range labelNames {
+			if _, exists := metric.Labels[labelName]; exists {
+				continue
+			}
+			metric.Labels[labelName] = node.label(labelName)
+		}
+	}
+	return metrics
+}
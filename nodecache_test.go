@@ -0,0 +1,37 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestNodeJoinKeepLabels(t *testing.T) {
+	cache := &NodeCache{nodes: map[string]map[string]NodeInfo{
+		"fab1": {"101": {ID: "101", Name: "leaf-101", Role: "leaf", Model: "N9K-C93180YC-FX", Serial: "FDO1"}},
+	}}
+
+	metrics := cache.join("fab1", []Metric{
+		{Labels: map[string]string{"nodeid": "101", "role": "border"}},
+		{Labels: map[string]string{"nodeid": "102"}},
+	}, &ConfigNodeJoin{Labels: []string{NodeLabelName, NodeLabelRole}})
+
+	if metrics[0].Labels[NodeLabelName] != "leaf-101" {
+		t.Errorf("expected node_name leaf-101, got %v", metrics[0].Labels)
+	}
+	if metrics[0].Labels[NodeLabelRole] != "border" {
+		t.Errorf("expected the role of the query kept, got %v", metrics[0].Labels)
+	}
+	if _, ok := metrics[1].Labels[NodeLabelName]; ok {
+		t.Errorf("expected no node labels for a node not in the cache, got %v", metrics[1].Labels)
+	}
+}
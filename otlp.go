@@ -0,0 +1,438 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// Supported OTLP protocols
+const (
+	OTLPProtocolGRPC = "grpc"
+	OTLPProtocolHTTP = "http"
+)
+
+var otlpPushMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: MetricsPrefix + "otlp_push",
+	Help: "Number of OTLP metric pushes",
+},
+	[]string{"fabric", "status"},
+)
+
+// OTLPExporter push the metrics of the fabrics to an OpenTelemetry collector, or any other OTLP receiver, on an
+// interval per fabric
+type OTLPExporter struct {
+	handler    *HandlerInit
+	endpoint   string
+	protocol   string
+	headers    map[string]string
+	interval   time.Duration
+	timeout    time.Duration
+	fabrics    []string
+	queries    []string
+	format     MetricFormat
+	startTime  time.Time
+	grpcConn   *grpc.ClientConn
+	grpcClient colmetricspb.MetricsServiceClient
+	httpClient *http.Client
+}
+
+// NewOTLPExporter create the exporter from the otlp configuration
+func NewOTLPExporter(handler *HandlerInit) (*OTLPExporter, error) {
+	exporter := &OTLPExporter{
+		handler:   handler,
+		endpoint:  viper.GetString("otlp.endpoint"),
+		protocol:  viper.GetString("otlp.protocol"),
+		headers:   viper.GetStringMapString("otlp.headers"),
+		interval:  viper.GetDuration("otlp.interval") * time.Second,
+		timeout:   viper.GetDuration("otlp.timeout") * time.Second,
+		fabrics:   viper.GetStringSlice("otlp.fabrics"),
+		queries:   viper.GetStringSlice("otlp.queries"),
+		format:    NewMetricFormat(false, viper.GetBool("metric_format.label_key_to_lower_case"), viper.GetBool("metric_format.label_key_to_snake_case")),
+		startTime: time.Now(),
+	}
+
+	if len(exporter.queries) == 0 {
+		// All queries
+		exporter.queries = nil
+	}
+
+	if exporter.endpoint == "" {
+		return nil, fmt.Errorf("otlp.endpoint must be set")
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: viper.GetBool("otlp.insecure_skip_verify")}
+
+	switch exporter.protocol {
+	case OTLPProtocolGRPC:
+		var creds credentials.TransportCredentials
+		if viper.GetBool("otlp.insecure") {
+			creds = insecure.NewCredentials()
+		} else {
+			creds = credentials.NewTLS(tlsConfig)
+		}
+		con, err := grpc.Dial(exporter.endpoint, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, err
+		}
+		exporter.grpcConn = con
+		exporter.grpcClient = colmetricspb.NewMetricsServiceClient(con)
+	case OTLPProtocolHTTP:
+		exporter.httpClient = &http.Client{
+			Timeout:   exporter.timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}
+	default:
+		return nil, fmt.Errorf("not supported otlp protocol %s, must be %s or %s", exporter.protocol, OTLPProtocolGRPC,
+			OTLPProtocolHTTP)
+	}
+
+	return exporter, nil
+}
+
+// Start a push loop for every fabric, also for fabrics added by a reload. The grpc connection is closed when the
+// exporter is shut down.
+func (o *OTLPExporter) Start() {
+	o.handler.startFabricLoops("otlp push", o.fabrics, o.run)
+	if o.grpcConn != nil {
+		started := o.handler.startLoop(func(ctx context.Context) {
+			<-ctx.Done()
+			o.close()
+		})
+		if !started {
+			o.close()
+		}
+	}
+}
+
+func (o *OTLPExporter) close() {
+	err := o.grpcConn.Close()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"endpoint": o.endpoint,
+		}).Warning("otlp grpc connection close failed - ", err)
+	}
+}
+
+func (o *OTLPExporter) run(ctx context.Context, fabricName string) {
+	interval := o.interval
+	if fabricConfig, ok := o.handler.fabric(fabricName); ok && fabricConfig.CollectionInterval > 0 {
+		interval = time.Duration(fabricConfig.CollectionInterval) * time.Second
+	}
+
+	log.WithFields(log.Fields{
+		LogFieldFabric: fabricName,
+		"endpoint":     o.endpoint,
+		"protocol":     o.protocol,
+		"interval":     interval.Seconds(),
+	}).Info("start otlp push")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		o.push(ctx, fabricName)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (o *OTLPExporter) push(ctx context.Context, fabricName string) {
+	ctx = context.WithValue(ctx, LogFieldRequestID, nextRequestID())
+	ctx = context.WithValue(ctx, LogFieldFabric, fabricName)
+
+	start := time.Now()
+	var aciName string
+	var metrics []MetricDefinition
+	var err error
+	// With background collection the latest collected metrics are pushed, to not collect the metrics twice
+	if o.handler.scheduler != nil {
+		aciName, metrics, err = o.handler.scheduler.Get(ctx, fabricName, o.queries, nil)
+	} else {
+		aciName, metrics, err = o.handler.collect(ctx, fabricName, o.queries, nil)
+	}
+	if ctx.Err() != nil {
+		// The exporter is shutting down
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			LogFieldRequestID: ctx.Value(LogFieldRequestID),
+			LogFieldFabric:    fabricName,
+		}).Warning("otlp collection failed - ", err)
+	}
+
+	request := metricsToOTLP(metrics, viper.GetString("prefix"), map[string]string{
+		"service.name": ExporterName,
+		"fabric":       fabricName,
+		"aci":          aciName,
+	}, o.format, o.startTime, time.Now())
+
+	pushCtx, cancel := context.WithTimeout(ctx, o.timeout)
+	defer cancel()
+
+	err = o.export(pushCtx, request)
+	if err != nil {
+		otlpPushMetric.With(prometheus.Labels{LogFieldFabric: fabricName, "status": "failed"}).Inc()
+		log.WithFields(log.Fields{
+			LogFieldRequestID: ctx.Value(LogFieldRequestID),
+			LogFieldFabric:    fabricName,
+			"endpoint":        o.endpoint,
+		}).Error("otlp push failed - ", err)
+		return
+	}
+
+	otlpPushMetric.With(prometheus.Labels{LogFieldFabric: fabricName, "status": "success"}).Inc()
+	log.WithFields(log.Fields{
+		LogFieldRequestID: ctx.Value(LogFieldRequestID),
+		LogFieldExecTime:  time.Since(start).Microseconds(),
+		LogFieldFabric:    fabricName,
+	}).Info("otlp push")
+}
+
+func (o *OTLPExporter) export(ctx context.Context, request *colmetricspb.ExportMetricsServiceRequest) error {
+	if o.grpcClient != nil {
+		if len(o.headers) > 0 {
+			ctx = metadata.NewOutgoingContext(ctx, metadata.New(o.headers))
+		}
+		_, err := o.grpcClient.Export(ctx, request)
+		return err
+	}
+
+	body, err := proto.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", o.endpoint, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range o.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("otlp receiver returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// metricsToOTLP convert the metrics to an OTLP export request. Counters are converted to cumulative monotonic sums
+// and all other types to gauges. The metric name is not suffixed with unit or _total as done for Prometheus.
+func metricsToOTLP(metrics []MetricDefinition, prefix string, resourceAttributes map[string]string,
+	format MetricFormat, startTime time.Time, now time.Time) *colmetricspb.ExportMetricsServiceRequest {
+
+	var otlpMetrics []*metricspb.Metric
+	for _, metricDefinition := range metrics {
+		if len(metricDefinition.Metrics) == 0 {
+			continue
+		}
+
+		otlpMetric := &metricspb.Metric{
+			Name:        prefix + metricDefinition.Name,
+			Description: metricDefinition.Description.Help,
+			Unit:        metricDefinition.Description.Unit,
+		}
+
+		switch metricDefinition.Description.Type {
+		case MetricTypeHistogram:
+			otlpMetric.Data = &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+				DataPoints:             toOTLPHistogram(metricDefinition.Metrics, format, startTime, now),
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			}}
+			otlpMetrics = append(otlpMetrics, otlpMetric)
+			continue
+		case MetricTypeSummary:
+			otlpMetric.Data = &metricspb.Metric_Summary{Summary: &metricspb.Summary{
+				DataPoints: toOTLPSummary(metricDefinition.Metrics, format, startTime, now),
+			}}
+			otlpMetrics = append(otlpMetrics, otlpMetric)
+			continue
+		}
+
+		var dataPoints []*metricspb.NumberDataPoint
+		for _, metric := range metricDefinition.Metrics {
+			dataPoints = append(dataPoints, &metricspb.NumberDataPoint{
+				Attributes:        toOTLPAttributes(metric.Labels, format),
+				StartTimeUnixNano: uint64(startTime.UnixNano()),
+				TimeUnixNano:      uint64(now.UnixNano()),
+				Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: metric.Value},
+			})
+		}
+
+		if metricDefinition.Description.Type == "counter" {
+			otlpMetric.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				DataPoints:             dataPoints,
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				IsMonotonic:            true,
+			}}
+		} else {
+			otlpMetric.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+				DataPoints: dataPoints,
+			}}
+		}
+		otlpMetrics = append(otlpMetrics, otlpMetric)
+	}
+
+	return &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{
+			{
+				Resource: &resourcepb.Resource{
+					Attributes: toOTLPAttributes(resourceAttributes, NewMetricFormat(false, false, false)),
+				},
+				ScopeMetrics: []*metricspb.ScopeMetrics{
+					{
+						Scope: &commonpb.InstrumentationScope{
+							Name:    ExporterName,
+							Version: version,
+						},
+						Metrics: otlpMetrics,
+					},
+				},
+			},
+		},
+	}
+}
+
+// toOTLPHistogram convert the cumulative Prometheus buckets to the explicit bounds and per bucket counts used by OTLP
+func toOTLPHistogram(metrics []Metric, format MetricFormat, startTime time.Time, now time.Time) []*metricspb.HistogramDataPoint {
+	var dataPoints []*metricspb.HistogramDataPoint
+	for _, metric := range metrics {
+		if metric.Distribution == nil {
+			continue
+		}
+		upperBounds := make([]float64, 0, len(metric.Distribution.Buckets))
+		for upperBound := range metric.Distribution.Buckets {
+			if !math.IsInf(upperBound, 1) {
+				upperBounds = append(upperBounds, upperBound)
+			}
+		}
+		sort.Float64s(upperBounds)
+
+		bucketCounts := make([]uint64, 0, len(upperBounds)+1)
+		previous := 0.0
+		for _, upperBound := range upperBounds {
+			bucketCounts = append(bucketCounts, bucketCount(metric.Distribution.Buckets[upperBound], previous))
+			previous = math.Max(previous, metric.Distribution.Buckets[upperBound])
+		}
+		bucketCounts = append(bucketCounts, bucketCount(metric.Distribution.Count, previous))
+
+		sum := metric.Distribution.Sum
+		dataPoints = append(dataPoints, &metricspb.HistogramDataPoint{
+			Attributes:        toOTLPAttributes(metric.Labels, format),
+			StartTimeUnixNano: uint64(startTime.UnixNano()),
+			TimeUnixNano:      uint64(now.UnixNano()),
+			Count:             uint64(metric.Distribution.Count),
+			Sum:               &sum,
+			BucketCounts:      bucketCounts,
+			ExplicitBounds:    upperBounds,
+		})
+	}
+	return dataPoints
+}
+
+// bucketCount return the count of the bucket from the cumulative counts, 0 if the cumulative count is less than the
+// previous bucket since the unsigned count would wrap
+func bucketCount(cumulative float64, previous float64) uint64 {
+	if cumulative < previous {
+		return 0
+	}
+	return uint64(cumulative - previous)
+}
+
+// toOTLPSummary convert the quantiles of summary metrics
+func toOTLPSummary(metrics []Metric, format MetricFormat, startTime time.Time, now time.Time) []*metricspb.SummaryDataPoint {
+	var dataPoints []*metricspb.SummaryDataPoint
+	for _, metric := range metrics {
+		if metric.Distribution == nil {
+			continue
+		}
+		quantiles := make([]float64, 0, len(metric.Distribution.Quantiles))
+		for quantile := range metric.Distribution.Quantiles {
+			quantiles = append(quantiles, quantile)
+		}
+		sort.Float64s(quantiles)
+
+		var quantileValues []*metricspb.SummaryDataPoint_ValueAtQuantile
+		for _, quantile := range quantiles {
+			quantileValues = append(quantileValues, &metricspb.SummaryDataPoint_ValueAtQuantile{
+				Quantile: quantile,
+				Value:    metric.Distribution.Quantiles[quantile],
+			})
+		}
+
+		dataPoints = append(dataPoints, &metricspb.SummaryDataPoint{
+			Attributes:        toOTLPAttributes(metric.Labels, format),
+			StartTimeUnixNano: uint64(startTime.UnixNano()),
+			TimeUnixNano:      uint64(now.UnixNano()),
+			Count:             uint64(metric.Distribution.Count),
+			Sum:               metric.Distribution.Sum,
+			QuantileValues:    quantileValues,
+		})
+	}
+	return dataPoints
+}
+
+// toOTLPAttributes convert labels to attributes sorted by key, empty values are filtered out as for Prometheus
+func toOTLPAttributes(labels map[string]string, format MetricFormat) []*commonpb.KeyValue {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	attributes := make([]*commonpb.KeyValue, 0, len(keys))
+	for _, k := range keys {
+		if labels[k] == "" {
+			continue
+		}
+		attributes = append(attributes, &commonpb.KeyValue{
+			Key:   toLowerLabels(k, format),
+			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: labels[k]}},
+		})
+	}
+	return attributes
+}
@@ -0,0 +1,308 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpReceiver is an in-process OTLP gRPC receiver that keep the received requests and headers
+type otlpReceiver struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+	requests chan *colmetricspb.ExportMetricsServiceRequest
+	headers  chan metadata.MD
+}
+
+func (r *otlpReceiver) Export(ctx context.Context, request *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	r.headers <- md
+	r.requests <- request
+	return &colmetricspb.ExportMetricsServiceResponse{}, nil
+}
+
+func testOTLPMetrics() []MetricDefinition {
+	return []MetricDefinition{
+		{
+			Name:        "interface_oper_state",
+			Description: MetricDesc{Help: "The interface state", Type: "gauge"},
+			Metrics: []Metric{
+				{Labels: map[string]string{"interface": "eth1/1", "nodeid": "101", "empty": ""}, Value: 1},
+				{Labels: map[string]string{"interface": "eth1/2", "nodeid": "101"}, Value: 0},
+			},
+		},
+		{
+			Name:        "uptime",
+			Description: MetricDesc{Help: "The uptime", Type: "counter", Unit: "seconds"},
+			Metrics:     []Metric{{Labels: map[string]string{"nodeid": "101"}, Value: 42}},
+		},
+		{
+			Name:        "no_series",
+			Description: MetricDesc{Type: "gauge"},
+		},
+	}
+}
+
+func attributesToMap(attributes []*commonpb.KeyValue) map[string]string {
+	m := make(map[string]string)
+	for _, attribute := range attributes {
+		m[attribute.Key] = attribute.Value.GetStringValue()
+	}
+	return m
+}
+
+func TestMetricsToOTLP(t *testing.T) {
+	start := time.Unix(1000, 0)
+	now := time.Unix(2000, 0)
+	request := metricsToOTLP(testOTLPMetrics(), "aci_", map[string]string{"fabric": "fab1", "aci": "ACI"},
+		NewMetricFormat(false, false, false), start, now)
+
+	if len(request.ResourceMetrics) != 1 {
+		t.Fatalf("expected 1 resource, got %d", len(request.ResourceMetrics))
+	}
+	resource := attributesToMap(request.ResourceMetrics[0].Resource.Attributes)
+	if resource["fabric"] != "fab1" || resource["aci"] != "ACI" {
+		t.Errorf("unexpected resource attributes %v", resource)
+	}
+
+	metrics := request.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	if len(metrics) != 2 {
+		t.Fatalf("metrics without series should be skipped, expected 2 metrics, got %d", len(metrics))
+	}
+
+	gauge := metrics[0]
+	if gauge.Name != "aci_interface_oper_state" || gauge.GetGauge() == nil {
+		t.Fatalf("expected gauge aci_interface_oper_state, got %s %T", gauge.Name, gauge.Data)
+	}
+	dataPoint := gauge.GetGauge().DataPoints[0]
+	if dataPoint.GetAsDouble() != 1 || dataPoint.TimeUnixNano != uint64(now.UnixNano()) {
+		t.Errorf("unexpected data point %v", dataPoint)
+	}
+	if len(dataPoint.Attributes) != 2 || dataPoint.Attributes[0].Key != "interface" {
+		t.Errorf("expected sorted attributes without empty values, got %v", dataPoint.Attributes)
+	}
+
+	sum := metrics[1]
+	if sum.Name != "aci_uptime" || sum.Unit != "seconds" || sum.GetSum() == nil {
+		t.Fatalf("expected sum aci_uptime without suffix, got %s %T", sum.Name, sum.Data)
+	}
+	if !sum.GetSum().IsMonotonic || sum.GetSum().DataPoints[0].StartTimeUnixNano != uint64(start.UnixNano()) {
+		t.Errorf("expected cumulative monotonic sum from start time, got %v", sum.GetSum())
+	}
+}
+
+func TestOTLPExportGRPC(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := &otlpReceiver{
+		requests: make(chan *colmetricspb.ExportMetricsServiceRequest, 1),
+		headers:  make(chan metadata.MD, 1),
+	}
+	server := grpc.NewServer()
+	colmetricspb.RegisterMetricsServiceServer(server, receiver)
+	go func() { _ = server.Serve(listener) }()
+	defer server.Stop()
+
+	viper.Set("otlp.endpoint", listener.Addr().String())
+	viper.Set("otlp.protocol", OTLPProtocolGRPC)
+	viper.Set("otlp.insecure", true)
+	viper.Set("otlp.headers", map[string]string{"x-tenant": "aci"})
+	viper.Set("otlp.timeout", 5)
+	defer viper.Reset()
+
+	exporter, err := NewOTLPExporter(&HandlerInit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	request := metricsToOTLP(testOTLPMetrics(), "aci_", map[string]string{"fabric": "fab1"},
+		NewMetricFormat(false, false, false), time.Now(), time.Now())
+	err = exporter.export(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := <-receiver.requests
+	if !proto.Equal(received, request) {
+		t.Errorf("received request differ from the pushed request")
+	}
+	md := <-receiver.headers
+	if len(md.Get("x-tenant")) != 1 || md.Get("x-tenant")[0] != "aci" {
+		t.Errorf("expected header x-tenant, got %v", md)
+	}
+}
+
+func TestOTLPExportHTTP(t *testing.T) {
+	received := make(chan *colmetricspb.ExportMetricsServiceRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/x-protobuf" || r.Header.Get("X-Tenant") != "aci" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		request := &colmetricspb.ExportMetricsServiceRequest{}
+		if err := proto.Unmarshal(body, request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- request
+	}))
+	defer server.Close()
+
+	viper.Set("otlp.endpoint", server.URL+"/v1/metrics")
+	viper.Set("otlp.protocol", OTLPProtocolHTTP)
+	viper.Set("otlp.headers", map[string]string{"X-Tenant": "aci"})
+	viper.Set("otlp.timeout", 5)
+	defer viper.Reset()
+
+	exporter, err := NewOTLPExporter(&HandlerInit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := metricsToOTLP(testOTLPMetrics(), "aci_", map[string]string{"fabric": "fab1"},
+		NewMetricFormat(false, false, false), time.Now(), time.Now())
+	err = exporter.export(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(<-received, request) {
+		t.Errorf("received request differ from the pushed request")
+	}
+}
+
+func TestOTLPExportHTTPError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	viper.Set("otlp.endpoint", server.URL)
+	viper.Set("otlp.protocol", OTLPProtocolHTTP)
+	viper.Set("otlp.timeout", 5)
+	defer viper.Reset()
+
+	exporter, err := NewOTLPExporter(&HandlerInit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = exporter.export(context.Background(), &colmetricspb.ExportMetricsServiceRequest{})
+	if err == nil {
+		t.Errorf("expected an error for status 503")
+	}
+}
+
+func TestNewOTLPExporterProtocol(t *testing.T) {
+	viper.Set("otlp.endpoint", "localhost:4317")
+	viper.Set("otlp.protocol", "udp")
+	defer viper.Reset()
+
+	_, err := NewOTLPExporter(&HandlerInit{})
+	if err == nil {
+		t.Errorf("expected an error for protocol udp")
+	}
+}
+
+func TestOTLPHistogramBucketCounts(t *testing.T) {
+	metrics := []Metric{{
+		Labels: map[string]string{"interface": "eth1/1"},
+		Distribution: &Distribution{
+			// The second bucket is less than the first, the count must not wrap
+			Buckets: map[float64]float64{1: 5, 2: 4, math.Inf(1): 6},
+			Count:   6,
+			Sum:     10,
+		},
+	}}
+	dataPoints := toOTLPHistogram(metrics, NewMetricFormat(false, false, false), time.Unix(1000, 0), time.Unix(2000, 0))
+	if len(dataPoints) != 1 {
+		t.Fatalf("expected 1 data point, got %d", len(dataPoints))
+	}
+	expected := []uint64{5, 0, 1}
+	if !reflect.DeepEqual(dataPoints[0].BucketCounts, expected) {
+		t.Errorf("expected bucket counts %v, got %v", expected, dataPoints[0].BucketCounts)
+	}
+}
+
+func TestOTLPPushBackgroundCollection(t *testing.T) {
+	handler, _ := newReloadTestHandler(t)
+	received := make(chan *colmetricspb.ExportMetricsServiceRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		request := &colmetricspb.ExportMetricsServiceRequest{}
+		if err := proto.Unmarshal(body, request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- request
+	}))
+	defer server.Close()
+
+	viper.Set("otlp.endpoint", server.URL)
+	viper.Set("otlp.protocol", OTLPProtocolHTTP)
+	viper.Set("otlp.timeout", 5)
+	exporter, err := NewOTLPExporter(handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fabric has no apic, the pushed metrics must be the collected metrics of the scheduler
+	handler.scheduler = NewScheduler(handler, time.Hour, 0)
+	ready := make(chan struct{})
+	close(ready)
+	job := &collectionJob{key: jobKey("fab1", nil, nil), fabric: "fab1", cancel: func() {}, ready: ready,
+		aciName: "ACI", metrics: testOTLPMetrics(), collected: time.Now()}
+	handler.scheduler.jobs[job.key] = job
+
+	exporter.push(context.Background(), "fab1")
+	request := <-received
+	attributes := attributesToMap(request.ResourceMetrics[0].Resource.Attributes)
+	if attributes["aci"] != "ACI" {
+		t.Errorf("expected the metrics of the background collection pushed, got %v", attributes)
+	}
+}
+
+func TestOTLPCloseGRPCOnShutdown(t *testing.T) {
+	handler := NewHandlerInit(AllQueries{}, map[string]*Fabric{})
+	viper.Set("otlp.endpoint", "127.0.0.1:1")
+	viper.Set("otlp.protocol", OTLPProtocolGRPC)
+	viper.Set("otlp.insecure", true)
+	defer viper.Reset()
+
+	exporter, err := NewOTLPExporter(handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter.Start()
+	handler.stop(time.Second)
+	if state := exporter.grpcConn.GetState(); state != connectivity.Shutdown {
+		t.Errorf("expected the grpc connection closed, got %s", state)
+	}
+}
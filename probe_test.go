@@ -0,0 +1,239 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+var update = flag.Bool("update", false, "Update the golden files of the tests")
+
+// newProbeTestHandler return a handler of the testdata configuration with the fabric served by a fake apic of the
+// recordings in testdata
+func newProbeTestHandler(t *testing.T) *HandlerInit {
+	t.Helper()
+	fakeApic := httptest.NewServer(&FakeApic{directory: filepath.Join("testdata", "recordings", "fake")})
+	t.Cleanup(fakeApic.Close)
+
+	SetDefaultValues()
+	viper.SetConfigFile(filepath.Join("testdata", "probe.yaml"))
+	err := viper.ReadInConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		removeConnections("fake")
+		viper.Reset()
+	})
+
+	configDirName := "config.d"
+	allQueries, err := loadQueries(viper.GetViper(), &configDirName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allFabrics, err := loadFabrics(viper.GetViper())
+	if err != nil {
+		t.Fatal(err)
+	}
+	allFabrics["fake"].Apic = []string{fakeApic.URL}
+
+	return NewHandlerInit(allQueries, allFabrics)
+}
+
+// normalizeProbe remove the lines that differ between scrapes, like durations, and sort the lines since the order
+// of the queries is not defined
+func normalizeProbe(body string) string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		if strings.Contains(line, "duration") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// assertGolden compare the content with the golden file, or write the golden file if -update is set
+func assertGolden(t *testing.T, golden string, content string) {
+	t.Helper()
+	goldenFile := filepath.Join("testdata", golden)
+	if *update {
+		err := os.WriteFile(goldenFile, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := os.ReadFile(goldenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(expected) != content {
+		t.Errorf("%s differ, got:\n%s\nexpected:\n%s", golden, content, expected)
+	}
+}
+
+func TestProbeGolden(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		golden string
+	}{
+		{name: "class query", query: "queries=interface_info", status: http.StatusOK, golden: "probe_class.golden"},
+		{name: "paged class query", query: "queries=paged", status: http.StatusOK, golden: "probe_paged.golden"},
+		{name: "compound query", query: "queries=object_count", status: http.StatusOK, golden: "probe_compound.golden"},
+		{name: "failed class of compound query", query: "queries=object_count_broken", status: http.StatusOK,
+			golden: "probe_compound_broken.golden"},
+		{name: "group query", query: "queries=interfaces_up", status: http.StatusOK, golden: "probe_group.golden"},
+		{name: "failed class query", query: "queries=broken", status: http.StatusOK, golden: "probe_broken.golden"},
+		{name: "all queries", query: "", status: http.StatusOK, golden: "probe_all.golden"},
+	}
+
+	handler := newProbeTestHandler(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/probe?target=fake&"+test.query, nil)
+			recorder := httptest.NewRecorder()
+			handler.getMonitorMetrics(recorder, request)
+
+			if recorder.Code != test.status {
+				t.Errorf("expected status %d, got %d", test.status, recorder.Code)
+			}
+			body, _ := io.ReadAll(recorder.Body)
+			assertGolden(t, test.golden, normalizeProbe(string(body)))
+		})
+	}
+}
+
+func TestProbeInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{name: "unknown query", query: "target=fake&queries=unknown", status: http.StatusBadRequest},
+		{name: "unknown fabric", query: "target=unknown", status: http.StatusNotFound},
+		{name: "fabric not lower case", query: "target=Fake", status: http.StatusBadRequest},
+		{name: "node without queries", query: "target=fake&node=leaf101", status: http.StatusBadRequest},
+	}
+
+	handler := newProbeTestHandler(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handler.getMonitorMetrics(recorder, httptest.NewRequest(http.MethodGet, "/probe?"+test.query, nil))
+			if recorder.Code != test.status {
+				t.Errorf("expected status %d, got %d", test.status, recorder.Code)
+			}
+		})
+	}
+}
+
+func TestSlicePage(t *testing.T) {
+	body := []byte(`{"totalCount":"5","imdata":[1,2,3,4,5]}`)
+	tests := []struct {
+		page     int
+		expected string
+	}{
+		{page: 0, expected: `{"totalCount":"5","imdata":[1,2]}`},
+		{page: 2, expected: `{"totalCount":"5","imdata":[5]}`},
+		{page: 3, expected: `{"totalCount":"5","imdata":[]}`},
+	}
+	for _, test := range tests {
+		page, err := slicePage(body, test.page, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(page) != test.expected {
+			t.Errorf("page %d expected %s, got %s", test.page, test.expected, page)
+		}
+	}
+}
+
+func TestRecordingKey(t *testing.T) {
+	key := recordingKey("https://apic/api/class/fvCEp.json?page-size=3&page=1&order-by=fvCEp.dn&query-target=self")
+	if key != "/api/class/fvCEp.json?order-by=fvCEp.dn&query-target=self" {
+		t.Errorf("unexpected recording key %s", key)
+	}
+}
+
+func TestRecordTransportError(t *testing.T) {
+	var failed atomic.Bool
+	con := newRetryTestConnection(t, func(w http.ResponseWriter, r *http.Request) {
+		if !failed.Load() {
+			_, _ = w.Write([]byte(`{"totalCount":"0","imdata":[]}`))
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			_ = conn.Close()
+		}
+	})
+	viper.Set("httpclient.retries", 0)
+
+	directory := t.TempDir()
+	var err error
+	recorder, err = NewRecorder(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { recorder = nil })
+
+	requestURL := con.controller() + "/api/class/fvTenant.json"
+	_, status, err := con.get(context.Background(), "fvTenant", requestURL)
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("expected a successful request, got %d %v", status, err)
+	}
+	failed.Store(true)
+	_, status, err = con.get(context.Background(), "fvTenant", requestURL)
+	if err == nil || status != 0 {
+		t.Fatalf("expected a transport error, got %d %v", status, err)
+	}
+
+	fakeApic := httptest.NewServer(&FakeApic{directory: filepath.Join(directory, "retry")})
+	defer fakeApic.Close()
+	response, err := http.Get(fakeApic.URL + "/api/class/fvTenant.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("expected the successful recording replayed, got %d", response.StatusCode)
+	}
+
+	err = os.WriteFile(filepath.Join(directory, "retry", recordingFileName(requestURL)),
+		[]byte(`{"url":"/api/class/fvTenant.json","status":0,"body":null}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err = http.Get(fakeApic.URL + "/api/class/fvTenant.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected 500 of a recording without status, got %d", response.StatusCode)
+	}
+}
@@ -0,0 +1,154 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// queryStatus collect the outcome of every query executed during a single collection
+type queryStatus struct {
+	mutex   sync.Mutex
+	results map[string]queryResult
+	// limits is the exceeded limits of the queries
+	limits map[string][]string
+	// failed is the queries that exceeded a limit with the action fail
+	failed []string
+}
+
+type queryResult struct {
+	success  bool
+	duration float64
+	series   int
+}
+
+func newQueryStatus() *queryStatus {
+	return &queryStatus{
+		results: make(map[string]queryResult),
+		limits:  make(map[string][]string),
+	}
+}
+
+// add the result of the named query, started at start
+func (q *queryStatus) add(name string, start time.Time, metricDefinitions []MetricDefinition, err error) {
+	series := 0
+	for _, metricDefinition := range metricDefinitions {
+		series = series + len(metricDefinition.Metrics)
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.results[name] = queryResult{
+		success:  err == nil,
+		duration: time.Since(start).Seconds(),
+		series:   series,
+	}
+}
+
+// addLimits add the limits exceeded by the named query
+func (q *queryStatus) addLimits(name string, state *limitState) {
+	exceeded := state.exceededLimits()
+	if len(exceeded) == 0 {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.limits[name] = exceeded
+	if state.failed() {
+		q.failed = append(q.failed, name)
+	}
+}
+
+// err return an error if any query exceeded a limit with the action fail
+func (q *queryStatus) err() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.failed) == 0 {
+		return nil
+	}
+	sort.Strings(q.failed)
+	return fmt.Errorf("queries %s exceeded a query limit", strings.Join(q.failed, ","))
+}
+
+// metrics return the query_success, query_duration_seconds, query_series_count and query_limit_exceeded metrics
+// labeled by query name
+func (q *queryStatus) metrics() []MetricDefinition {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.results) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(q.results))
+	for name := range q.results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	success := MetricDefinition{
+		Name: "query_success",
+		Description: MetricDesc{
+			Help: "The status of the query 1=successful, 0=failed",
+			Type: "gauge",
+		},
+	}
+	duration := MetricDefinition{
+		Name: "query_duration",
+		Description: MetricDesc{
+			Help: "The duration, in seconds, of the query",
+			Type: "gauge",
+			Unit: "seconds",
+		},
+	}
+	series := MetricDefinition{
+		Name: "query_series_count",
+		Description: MetricDesc{
+			Help: "The number of series returned by the query",
+			Type: "gauge",
+		},
+	}
+
+	limitExceeded := MetricDefinition{
+		Name: "query_limit_exceeded",
+		Description: MetricDesc{
+			Help: "The query exceeded the limit, the series of the query are truncated or dropped",
+			Type: "gauge",
+		},
+	}
+
+	for _, name := range names {
+		for _, limit := range q.limits[name] {
+			limitExceeded.Metrics = append(limitExceeded.Metrics,
+				Metric{Labels: map[string]string{"query": name, "limit": limit}, Value: 1.0})
+		}
+		result := q.results[name]
+		successValue := 0.0
+		if result.success {
+			successValue = 1.0
+		}
+		success.Metrics = append(success.Metrics, Metric{Labels: map[string]string{"query": name}, Value: successValue})
+		duration.Metrics = append(duration.Metrics, Metric{Labels: map[string]string{"query": name}, Value: result.duration})
+		series.Metrics = append(series.Metrics, Metric{Labels: map[string]string{"query": name}, Value: float64(result.series)})
+	}
+
+	metricDefinitions := []MetricDefinition{success, duration, series}
+	if len(limitExceeded.Metrics) > 0 {
+		metricDefinitions = append(metricDefinitions, limitExceeded)
+	}
+	return metricDefinitions
+}
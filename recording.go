@@ -0,0 +1,358 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	"golang.org/x/net/websocket"
+)
+
+// The token returned by the fake apic on login and refresh
+const fakeApicToken = "fake-apic-token"
+
+// recorder is set if responses should be recorded
+var recorder *Recorder
+
+var unsafePathChars = regexp.MustCompile("[^a-zA-Z0-9._-]")
+
+// Recording a recorded response of a GET request
+type Recording struct {
+	URL    string          `json:"url"`
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body"`
+}
+
+// Recorder write every response from the apic and nodes to a directory per fabric. Node responses are written to a
+// sub directory named by the node.
+type Recorder struct {
+	directory string
+	mutex     sync.Mutex
+}
+
+// NewRecorder create the recorder and the directory
+func NewRecorder(directory string) (*Recorder, error) {
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{directory: directory}, nil
+}
+
+// recordingKey return the path and query of the url, with the paging and subscription parameters removed and the
+// parameters sorted
+func recordingKey(requestURL string) string {
+	u, err := url.Parse(requestURL)
+	if err != nil {
+		return requestURL
+	}
+	query := u.Query()
+	query.Del("page")
+	query.Del("page-size")
+	query.Del("subscription")
+	if len(query) == 0 {
+		return u.Path
+	}
+	return u.Path + "?" + query.Encode()
+}
+
+// recordingFileName return the file name of the recording of the url
+func recordingFileName(requestURL string) string {
+	hash := sha256.Sum256([]byte(recordingKey(requestURL)))
+	return hex.EncodeToString(hash[:8]) + ".json"
+}
+
+// record write the response of the url, a failed response do not replace a successful recording of the url
+func (r *Recorder) record(fabricName string, node *string, requestURL string, status int, body []byte) {
+	directory := filepath.Join(r.directory, unsafePathChars.ReplaceAllString(fabricName, "_"))
+	if node != nil {
+		nodeURL, err := url.Parse(*node)
+		if err == nil {
+			directory = filepath.Join(directory, "node-"+unsafePathChars.ReplaceAllString(nodeURL.Host, "_"))
+		}
+	}
+
+	recording := Recording{
+		URL:    recordingKey(requestURL),
+		Status: status,
+		Body:   body,
+	}
+	if !json.Valid(body) {
+		recording.Body = json.RawMessage("null")
+	}
+
+	content, err := json.MarshalIndent(recording, "", "  ")
+	if err == nil {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		fileName := filepath.Join(directory, recordingFileName(requestURL))
+		if status != http.StatusOK && recordedStatus(fileName) == http.StatusOK {
+			log.WithFields(log.Fields{
+				LogFieldFabric: fabricName,
+				"uri":          requestURL,
+				"status":       status,
+			}).Warning("failed response not recorded, the url has a successful recording")
+			return
+		}
+		err = os.MkdirAll(directory, 0755)
+		if err == nil {
+			err = os.WriteFile(fileName, content, 0644)
+		}
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			LogFieldFabric: fabricName,
+			"uri":          requestURL,
+		}).Error("recording failed - ", err)
+	}
+}
+
+// recordedStatus return the status of the recording in the file, 0 if there is no valid recording
+func recordedStatus(fileName string) int {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return 0
+	}
+	recording := Recording{}
+	if json.Unmarshal(content, &recording) != nil {
+		return 0
+	}
+	return recording.Status
+}
+
+// FakeApic serve recorded responses as an apic, login and refresh always succeed. Subscriptions are accepted on
+// all recorded class queries and the events posted to /fake/event are sent on the websockets.
+type FakeApic struct {
+	directory string
+	mutex     sync.Mutex
+	// subscription id -> class
+	subscriptions map[string]string
+	sockets       map[*websocket.Conn]bool
+	nextID        int
+}
+
+func NewFakeApic(directory string) *FakeApic {
+	return &FakeApic{
+		directory:     directory,
+		subscriptions: make(map[string]string),
+		sockets:       make(map[*websocket.Conn]bool),
+	}
+}
+
+// ServeHTTP serve the recorded response of the request. If the request includes page-size the page is sliced from
+// the recorded response.
+func (f *FakeApic) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lrw := loggingResponseWriter{ResponseWriter: w}
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.URL.Path {
+	case "/api/aaaLogin.json", "/api/aaaRefresh.json":
+		lrw.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"totalCount":"1","imdata":[{"aaaLogin":{"attributes":{"token":"%s",`+
+			`"refreshTimeoutSeconds":"600","maximumLifetimeSeconds":"86400"}}}]}`, fakeApicToken)
+		return
+	case "/api/aaaLogout.json", "/api/subscriptionRefresh.json":
+		lrw.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"totalCount":"0","imdata":[]}`))
+		return
+	case "/fake/event":
+		f.event(&lrw, r)
+		return
+	}
+
+	content, err := os.ReadFile(filepath.Join(f.directory, recordingFileName(r.URL.String())))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uri": r.URL.String(),
+		}).Warning("no recording found")
+		lrw.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprintf(w, `{"totalCount":"1","imdata":[{"error":{"attributes":{"code":"400",`+
+			`"text":"no recording of %s"}}}]}`, recordingKey(r.URL.String()))
+		return
+	}
+
+	recording := Recording{}
+	err = json.Unmarshal(content, &recording)
+	if err == nil && recording.Status < 100 {
+		err = fmt.Errorf("status %d is not valid", recording.Status)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uri": r.URL.String(),
+		}).Error("recording not valid - ", err)
+		lrw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	body := []byte(recording.Body)
+	pageSize, err := strconv.Atoi(r.URL.Query().Get("page-size"))
+	if err == nil && pageSize > 0 && recording.Status == http.StatusOK {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		body, err = slicePage(body, page, pageSize)
+		if err != nil {
+			lrw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if r.URL.Query().Get("subscription") == "yes" && recording.Status == http.StatusOK {
+		body, err = f.subscribe(body, strings.TrimSuffix(filepath.Base(r.URL.Path), ".json"))
+		if err != nil {
+			lrw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	lrw.WriteHeader(recording.Status)
+	_, _ = w.Write(body)
+}
+
+// subscribe add a new subscription id for the class to the response
+func (f *FakeApic) subscribe(body []byte, class string) ([]byte, error) {
+	response := map[string]json.RawMessage{}
+	err := json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	f.nextID++
+	id := strconv.Itoa(f.nextID)
+	f.subscriptions[id] = class
+	f.mutex.Unlock()
+
+	response["subscriptionId"] = json.RawMessage(strconv.Quote(id))
+	return json.Marshal(response)
+}
+
+// event send the posted imdata, like {"imdata":[{"l1PhysIf":{"attributes":{"dn":"..","status":"modified"}}}]}, to
+// all websockets with the subscription ids of the classes in the imdata
+func (f *FakeApic) event(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil || r.Method != http.MethodPost || !gjson.ValidBytes(body) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	classes := make(map[string]bool)
+	gjson.GetBytes(body, "imdata").ForEach(func(key, value gjson.Result) bool {
+		value.ForEach(func(class, object gjson.Result) bool {
+			classes[class.String()] = true
+			return true
+		})
+		return true
+	})
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	ids := []string{}
+	for id, class := range f.subscriptions {
+		if classes[class] {
+			ids = append(ids, id)
+		}
+	}
+	message, _ := json.Marshal(map[string]interface{}{
+		"subscriptionId": ids,
+		"imdata":         json.RawMessage(gjson.GetBytes(body, "imdata").Raw),
+	})
+	for socket := range f.sockets {
+		_ = websocket.Message.Send(socket, string(message))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// socket keep the websocket open until closed by the client
+func (f *FakeApic) socket(socket *websocket.Conn) {
+	f.mutex.Lock()
+	f.sockets[socket] = true
+	f.mutex.Unlock()
+
+	log.WithFields(log.Fields{
+		"remote": socket.Request().RemoteAddr,
+	}).Info("fake apic websocket opened")
+	_, _ = io.Copy(io.Discard, socket)
+
+	f.mutex.Lock()
+	delete(f.sockets, socket)
+	f.mutex.Unlock()
+}
+
+// slicePage return the page of the imdata, the totalCount is the size of all imdata
+func slicePage(body []byte, page int, pageSize int) ([]byte, error) {
+	response := struct {
+		Imdata []json.RawMessage `json:"imdata"`
+	}{}
+	err := json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	start := page * pageSize
+	end := start + pageSize
+	if start > len(response.Imdata) {
+		start = len(response.Imdata)
+	}
+	if end > len(response.Imdata) {
+		end = len(response.Imdata)
+	}
+
+	imdata := response.Imdata[start:end]
+	if imdata == nil {
+		imdata = []json.RawMessage{}
+	}
+	return json.Marshal(struct {
+		TotalCount string            `json:"totalCount"`
+		Imdata     []json.RawMessage `json:"imdata"`
+	}{
+		TotalCount: strconv.Itoa(len(response.Imdata)),
+		Imdata:     imdata,
+	})
+}
+
+// runFakeApic serve the recordings in the directory, the directory of a single fabric or node, on the address
+func runFakeApic(directory string, address string) error {
+	_, err := os.Stat(directory)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"directory": strings.TrimSuffix(directory, "/"),
+		"address":   address,
+	}).Info("fake apic starting")
+
+	fakeApic := NewFakeApic(directory)
+	handler := logCall(fakeApic)
+	return http.ListenAndServe(address, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The websocket is /socket<token>
+		if strings.HasPrefix(r.URL.Path, "/socket") {
+			websocket.Handler(fakeApic.socket).ServeHTTP(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+}
@@ -0,0 +1,273 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	RelabelReplace   = "replace"
+	RelabelKeep      = "keep"
+	RelabelDrop      = "drop"
+	RelabelLabelMap  = "labelmap"
+	RelabelLabelDrop = "labeldrop"
+	RelabelLabelKeep = "labelkeep"
+	RelabelHashMod   = "hashmod"
+
+	// RelabelMetricName is the label with the name of the metric during relabeling
+	RelabelMetricName = "__name__"
+)
+
+var validRelabelActions = map[string]bool{
+	RelabelReplace:   true,
+	RelabelKeep:      true,
+	RelabelDrop:      true,
+	RelabelLabelMap:  true,
+	RelabelLabelDrop: true,
+	RelabelLabelKeep: true,
+	RelabelHashMod:   true,
+}
+
+// RelabelConfig is a Prometheus style relabel rule applied to the labels of the metrics
+type RelabelConfig struct {
+	SourceLabels []string `mapstructure:"source_labels" yaml:"source_labels"`
+	// Separator between the concatenated source label values, default ;
+	Separator   string `mapstructure:"separator" yaml:"separator"`
+	TargetLabel string `mapstructure:"target_label" yaml:"target_label"`
+	// Regex is anchored at both ends, default (.*)
+	Regex string `mapstructure:"regex" yaml:"regex"`
+	// Replacement is nil if not set since an empty replacement remove the target label, default $1
+	Replacement *string `mapstructure:"replacement" yaml:"replacement"`
+	Modulus     uint64  `mapstructure:"modulus" yaml:"modulus"`
+	// Action is replace, keep, drop, labelmap, labeldrop, labelkeep or hashmod, default replace
+	Action string `mapstructure:"action" yaml:"action"`
+	// compiled is the anchored regex, set by compileRelabelConfigs when the configuration is loaded
+	compiled *regexp.Regexp
+}
+
+// compileRelabelConfigs validate the rules and compile the regex of every rule
+func compileRelabelConfigs(rules []RelabelConfig) error {
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return fmt.Errorf("relabel_configs[%d] %s", i, err)
+		}
+		rules[i].compiled, _ = rules[i].regex()
+	}
+	return nil
+}
+
+// compileRelabelConfigs compile the relabel rules of all queries and the global rules, an invalid rule fail the load
+// of the configuration
+func (q AllQueries) compileRelabelConfigs() error {
+	for name, query := range q.ClassQueries {
+		if err := compileRelabelConfigs(query.RelabelConfigs); err != nil {
+			return fmt.Errorf("class query %s - %s", name, err)
+		}
+	}
+	for name, query := range q.CompoundClassQueries {
+		if err := compileRelabelConfigs(query.RelabelConfigs); err != nil {
+			return fmt.Errorf("compound query %s - %s", name, err)
+		}
+	}
+	for name, query := range q.GroupClassQueries {
+		if err := compileRelabelConfigs(query.RelabelConfigs); err != nil {
+			return fmt.Errorf("group class query %s - %s", name, err)
+		}
+		for i := range query.Queries {
+			if err := compileRelabelConfigs(query.Queries[i].RelabelConfigs); err != nil {
+				return fmt.Errorf("group class query %s.queries[%d] - %s", name, i, err)
+			}
+		}
+	}
+	return compileRelabelConfigs(q.RelabelConfigs)
+}
+
+func (r RelabelConfig) action() string {
+	if r.Action == "" {
+		return RelabelReplace
+	}
+	return r.Action
+}
+
+func (r RelabelConfig) separator() string {
+	if r.Separator == "" {
+		return ";"
+	}
+	return r.Separator
+}
+
+func (r RelabelConfig) replacement() string {
+	if r.Replacement == nil {
+		return "$1"
+	}
+	return *r.Replacement
+}
+
+// regex return the regex of the rule anchored at both ends
+func (r RelabelConfig) regex() (*regexp.Regexp, error) {
+	regex := r.Regex
+	if regex == "" {
+		regex = "(.*)"
+	}
+	return regexp.Compile("^(?:" + regex + ")$")
+}
+
+// validate the rule
+func (r RelabelConfig) validate() error {
+	if !validRelabelActions[r.action()] {
+		return fmt.Errorf("relabel action %s is not valid", r.Action)
+	}
+	_, err := r.regex()
+	if err != nil {
+		return fmt.Errorf("relabel regex %q is not valid - %s", r.Regex, err)
+	}
+	switch r.action() {
+	case RelabelReplace, RelabelHashMod:
+		if r.TargetLabel == "" {
+			return fmt.Errorf("relabel action %s require target_label", r.action())
+		}
+		// The metric name can be a source label but is not set from the labels
+		if r.TargetLabel == RelabelMetricName {
+			return fmt.Errorf("relabel target_label %s is not supported", RelabelMetricName)
+		}
+	case RelabelLabelMap:
+		if strings.HasPrefix(r.replacement(), "__") {
+			return fmt.Errorf("relabel labelmap replacement %q can not start with __", r.replacement())
+		}
+	}
+	if r.action() == RelabelHashMod && r.Modulus == 0 {
+		return fmt.Errorf("relabel action hashmod require modulus")
+	}
+	return nil
+}
+
+// relabelMetrics apply the rules to the labels of all metrics, metrics dropped by the rules are removed. The labels
+// of the metrics are not modified, relabeled metrics get new labels. If the rules can not be applied no metrics are
+// returned, since a skipped keep or drop rule would expose metrics the rules exclude.
+func relabelMetrics(metricDefinitions []MetricDefinition, rules []RelabelConfig) []MetricDefinition {
+	if len(rules) == 0 {
+		return metricDefinitions
+	}
+
+	relabeled := make([]MetricDefinition, 0, len(metricDefinitions))
+	for _, metricDefinition := range metricDefinitions {
+		metrics := make([]Metric, 0, len(metricDefinition.Metrics))
+		for _, metric := range metricDefinition.Metrics {
+			labels, keep, err := relabel(metricDefinition.Name, metric.Labels, rules)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"metric": metricDefinition.Name,
+				}).Error("relabel failed - ", err)
+				return nil
+			}
+			if !keep {
+				continue
+			}
+			metric.Labels = labels
+			metrics = append(metrics, metric)
+		}
+		metricDefinition.Metrics = metrics
+		relabeled = append(relabeled, metricDefinition)
+	}
+	return relabeled
+}
+
+// relabel apply the compiled rules to a copy of the labels and return the new labels, or false if the metric is dropped. The
+// name of the metric is the label __name__ and all labels starting with __ are removed after the rules.
+func relabel(name string, labels map[string]string, rules []RelabelConfig) (map[string]string, bool, error) {
+	relabeled := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		relabeled[k] = v
+	}
+	relabeled[RelabelMetricName] = name
+
+	for i, rule := range rules {
+		// The rules are compiled when the configuration is loaded
+		re := rule.compiled
+		if re == nil {
+			return nil, false, fmt.Errorf("relabel rule %d is not compiled", i)
+		}
+
+		values := make([]string, 0, len(rule.SourceLabels))
+		for _, sourceLabel := range rule.SourceLabels {
+			values = append(values, relabeled[sourceLabel])
+		}
+		value := strings.Join(values, rule.separator())
+
+		switch rule.action() {
+		case RelabelReplace:
+			match := re.FindStringSubmatchIndex(value)
+			if match == nil {
+				continue
+			}
+			target := string(re.ExpandString(nil, rule.TargetLabel, value, match))
+			if !labelNameRegex.MatchString(target) || target == RelabelMetricName {
+				continue
+			}
+			replacement := string(re.ExpandString(nil, rule.replacement(), value, match))
+			if replacement == "" {
+				delete(relabeled, target)
+				continue
+			}
+			relabeled[target] = replacement
+		case RelabelKeep:
+			if !re.MatchString(value) {
+				return nil, false, nil
+			}
+		case RelabelDrop:
+			if re.MatchString(value) {
+				return nil, false, nil
+			}
+		case RelabelHashMod:
+			sum := md5.Sum([]byte(value))
+			mod := binary.BigEndian.Uint64(sum[8:]) % rule.Modulus
+			relabeled[rule.TargetLabel] = strconv.FormatUint(mod, 10)
+		case RelabelLabelMap:
+			mapped := make(map[string]string)
+			for k, v := range relabeled {
+				if re.MatchString(k) {
+					mapped[re.ReplaceAllString(k, rule.replacement())] = v
+				}
+			}
+			for k, v := range mapped {
+				relabeled[k] = v
+			}
+		case RelabelLabelDrop:
+			for k := range relabeled {
+				if k != RelabelMetricName && re.MatchString(k) {
+					delete(relabeled, k)
+				}
+			}
+		case RelabelLabelKeep:
+			for k := range relabeled {
+				if k != RelabelMetricName && !re.MatchString(k) {
+					delete(relabeled, k)
+				}
+			}
+		}
+	}
+
+	for k := range relabeled {
+		if strings.HasPrefix(k, "__") {
+			delete(relabeled, k)
+		}
+	}
+	return relabeled, true, nil
+}
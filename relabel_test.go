@@ -0,0 +1,102 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// loadRelabelTestQueries load the queries of the configuration with the global relabel rules
+func loadRelabelTestQueries(t *testing.T, relabelConfigs string) (AllQueries, error) {
+	t.Helper()
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	writeReloadTestConfig(t, configFile, reloadTestConfig+relabelConfigs)
+
+	v := viper.New()
+	setDefaultValues(v)
+	v.SetConfigFile(configFile)
+	err := v.ReadInConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDirName := "config.d"
+	return loadQueries(v, &configDirName)
+}
+
+func TestRelabelCompiledAtLoad(t *testing.T) {
+	allQueries, err := loadRelabelTestQueries(t, `
+relabel_configs:
+  - source_labels: [tenant]
+    regex: "t(.*)"
+    target_label: tenant
+    replacement: "tenant-$1"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allQueries.RelabelConfigs[0].compiled == nil {
+		t.Fatal("expected the regex compiled at load")
+	}
+
+	labels, keep, err := relabel("tenant", map[string]string{"tenant": "t1"}, allQueries.RelabelConfigs)
+	if err != nil || !keep || labels["tenant"] != "tenant-1" {
+		t.Errorf("expected tenant relabeled to tenant-1, got %v", labels)
+	}
+}
+
+func TestRelabelInvalidAtLoad(t *testing.T) {
+	_, err := loadRelabelTestQueries(t, `
+relabel_configs:
+  - source_labels: [tenant]
+    regex: "t(.*"
+    target_label: tenant
+`)
+	if err == nil || !strings.Contains(err.Error(), "relabel_configs[0]") {
+		t.Fatalf("expected invalid relabel regex to fail the load, got %v", err)
+	}
+}
+
+func TestRelabelMetricNameTarget(t *testing.T) {
+	tests := []string{`
+relabel_configs:
+  - source_labels: [tenant]
+    target_label: __name__
+`, `
+relabel_configs:
+  - regex: "(.*)"
+    action: labelmap
+    replacement: "__$1"
+`}
+	for _, test := range tests {
+		_, err := loadRelabelTestQueries(t, test)
+		if err == nil {
+			t.Errorf("expected the load to fail on a rule writing __name__ - %s", test)
+		}
+	}
+}
+
+func TestRelabelNotCompiled(t *testing.T) {
+	rules := []RelabelConfig{{SourceLabels: []string{"tenant"}, Regex: "t1", Action: RelabelDrop}}
+	_, _, err := relabel("tenant", map[string]string{"tenant": "t1"}, rules)
+	if err == nil {
+		t.Fatal("expected an error of a rule not compiled")
+	}
+	metricDefinitions := relabelMetrics([]MetricDefinition{{Name: "tenant",
+		Metrics: []Metric{{Labels: map[string]string{"tenant": "t1"}}}}}, rules)
+	if len(metricDefinitions) != 0 {
+		t.Errorf("expected no metrics of rules not compiled, got %v", metricDefinitions)
+	}
+}
@@ -0,0 +1,182 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var configReloadSuccessMetric = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: MetricsPrefix + "config_last_reload_successful",
+	Help: "The status of the last configuration reload 1=successful, 0=failed",
+})
+
+var configReloadSuccessTimestampMetric = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: MetricsPrefix + "config_last_reload_success_timestamp_seconds",
+	Help: "Timestamp of the last successful configuration reload",
+})
+
+// reloadMutex make sure only one reload is done at the time
+var reloadMutex sync.Mutex
+
+// reload read the configuration file and directory and swap the queries and fabrics. Cached connections are kept
+// for fabrics where the configuration is not changed.
+func (h *HandlerInit) reload(configDirName *string) error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	err := h.loadAndSwap(configDirName)
+	if err != nil {
+		configReloadSuccessMetric.Set(0)
+		log.Error("Configuration reload failed - ", err)
+		return err
+	}
+
+	configReloadSuccessMetric.Set(1)
+	configReloadSuccessTimestampMetric.SetToCurrentTime()
+	return nil
+}
+
+// loadAndSwap load the configuration into a new viper instance and swap the queries and fabrics if the configuration
+// is valid. The global viper instance is only read after start, and the settings that are not swapped are kept.
+func (h *HandlerInit) loadAndSwap(configDirName *string) error {
+	v := viper.New()
+	setDefaultValues(v)
+	v.SetConfigFile(viper.ConfigFileUsed())
+	v.SetConfigType("yaml")
+	err := v.ReadInConfig()
+	if err != nil {
+		return fmt.Errorf("configuration file not valid - %s", err)
+	}
+
+	allQueries, err := loadQueries(v, configDirName)
+	if err != nil {
+		return err
+	}
+
+	allFabrics, err := loadFabrics(v)
+	if err != nil {
+		return fmt.Errorf("unable to load fabrics - %s", err)
+	}
+
+	h.configMutex.Lock()
+	oldFabrics := h.AllFabrics
+	h.AllQueries = allQueries
+	h.AllFabrics = allFabrics
+	h.querySet = createQueryNameSet(allQueries)
+	h.configMutex.Unlock()
+
+	// Secrets are read again in case the provider configuration is changed
+	clearSecretCache()
+
+	// Remove the connections of changed and removed fabrics, a new connection is created on next request
+	var changed []string
+	for fabricName, oldFabric := range oldFabrics {
+		newFabric, ok := allFabrics[fabricName]
+		if !ok || fabricChanged(oldFabric, newFabric) {
+			removeConnections(fabricName)
+			changed = append(changed, fabricName)
+		}
+	}
+
+	// Start the loops of added fabrics, stop the loops of removed fabrics and restart the loops of changed fabrics
+	h.syncFabricLoops(changed)
+
+	// The background collections of changed fabrics are restarted with the new configuration by the next request
+	if h.scheduler != nil {
+		h.scheduler.stopFabrics(changed)
+	}
+
+	log.WithFields(log.Fields{
+		"fabrics":          len(allFabrics),
+		"changed_fabrics":  strings.Join(changed, ","),
+		"class_queries":    len(allQueries.ClassQueries),
+		"compound_queries": len(allQueries.CompoundClassQueries),
+		"group_queries":    len(allQueries.GroupClassQueries),
+	}).Info("Configuration reloaded")
+
+	return nil
+}
+
+// fabricChanged compare the configuration of the fabric, the aci name is ignored if not configured since it is set
+// from the fabric on the first request. The http clients are always new after a load and are not compared.
+func fabricChanged(oldFabric *Fabric, newFabric *Fabric) bool {
+	compare := *oldFabric
+	if newFabric.AciName == "" {
+		compare.AciName = ""
+	}
+	compare.apicClient = newFabric.apicClient
+	compare.nodeClient = newFabric.nodeClient
+	return !reflect.DeepEqual(&compare, newFabric)
+}
+
+// reloadOnSignal reload the configuration every time the process get a SIGHUP
+func (h *HandlerInit) reloadOnSignal(configDirName *string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		log.Info("Received SIGHUP, reload configuration")
+		_ = h.reload(configDirName)
+	}
+}
+
+// reloadHandler reload the configuration on POST /-/reload, the request must include the header
+// Authorization: Bearer <reload.token>
+func (h *HandlerInit) reloadHandler(configDirName *string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lrw := loggingResponseWriter{ResponseWriter: w}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			lrw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(viper.GetString("reload.token"))) != 1 {
+			log.WithFields(log.Fields{
+				LogFieldRequestID: r.Context().Value(LogFieldRequestID),
+				"remote":          r.RemoteAddr,
+			}).Warning("not authorized to reload configuration")
+			lrw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		start := time.Now()
+		err := h.reload(configDirName)
+		if err != nil {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			lrw.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(fmt.Sprintf("Reload failed - %s\n", err)))
+			return
+		}
+
+		log.WithFields(log.Fields{
+			LogFieldRequestID: r.Context().Value(LogFieldRequestID),
+			LogFieldExecTime:  time.Since(start).Microseconds(),
+		}).Info("configuration reloaded by api")
+		lrw.WriteHeader(http.StatusOK)
+	}
+}
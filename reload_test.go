@@ -0,0 +1,260 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const reloadTestConfig = `
+fabrics:
+  fab1:
+    username: foo
+    password: bar
+    apic:
+      - https://127.0.0.1:1
+class_queries:
+  tenants:
+    class_name: fvTenant
+    metrics:
+      - name: tenant
+        value_name: fvTenant.attributes.name
+`
+
+// newReloadTestHandler return a handler of the configuration written to a temporary file
+func newReloadTestHandler(t *testing.T) (*HandlerInit, string) {
+	t.Helper()
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	writeReloadTestConfig(t, configFile, reloadTestConfig)
+
+	SetDefaultValues()
+	viper.SetConfigFile(configFile)
+	err := viper.ReadInConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configDirName := "config.d"
+	allQueries, err := loadQueries(viper.GetViper(), &configDirName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allFabrics, err := loadFabrics(viper.GetViper())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewHandlerInit(allQueries, allFabrics)
+	t.Cleanup(func() {
+		handler.stop(time.Second)
+		viper.Reset()
+	})
+	return handler, configFile
+}
+
+func writeReloadTestConfig(t *testing.T, configFile string, config string) {
+	t.Helper()
+	err := os.WriteFile(configFile, []byte(config), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadInvalidKeepConfig(t *testing.T) {
+	handler, configFile := newReloadTestHandler(t)
+	configDirName := "config.d"
+
+	writeReloadTestConfig(t, configFile, reloadTestConfig+`
+limits:
+  action: ignore
+`)
+	err := handler.reload(&configDirName)
+	if err == nil {
+		t.Fatal("expected reload to fail on invalid limits action")
+	}
+	if _, ok := handler.fabric("fab1"); !ok {
+		t.Error("fabric fab1 removed by failed reload")
+	}
+	if viper.GetString("limits.action") != LimitActionDrop {
+		t.Error("failed reload changed the global configuration")
+	}
+
+	writeReloadTestConfig(t, configFile, `
+fabrics:
+  fab2:
+    username: foo
+    password: bar
+    apic:
+      - https://127.0.0.1:1
+`)
+	err = handler.reload(&configDirName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := handler.fabric("fab1"); ok {
+		t.Error("fabric fab1 not removed by reload")
+	}
+	if _, ok := handler.fabric("fab2"); !ok {
+		t.Error("fabric fab2 not added by reload")
+	}
+	allQueries, _ := handler.queries()
+	if len(allQueries.ClassQueries) != 0 {
+		t.Errorf("expected no class queries after reload, got %d", len(allQueries.ClassQueries))
+	}
+}
+
+func TestFabricLoopsReload(t *testing.T) {
+	handler, configFile := newReloadTestHandler(t)
+	configDirName := "config.d"
+
+	var mutex sync.Mutex
+	running := make(map[string]int)
+	started := make(chan string, 10)
+	handler.startFabricLoops("test", nil, func(ctx context.Context, fabricName string) {
+		mutex.Lock()
+		running[fabricName]++
+		mutex.Unlock()
+		started <- fabricName
+		<-ctx.Done()
+		mutex.Lock()
+		running[fabricName]--
+		mutex.Unlock()
+	})
+
+	if fabricName := <-started; fabricName != "fab1" {
+		t.Fatalf("expected loop of fab1 started, got %s", fabricName)
+	}
+
+	writeReloadTestConfig(t, configFile, `
+fabrics:
+  fab2:
+    username: foo
+    password: bar
+    apic:
+      - https://127.0.0.1:1
+`)
+	err := handler.reload(&configDirName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fabricName := <-started; fabricName != "fab2" {
+		t.Fatalf("expected loop of fab2 started, got %s", fabricName)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mutex.Lock()
+		fab1, fab2 := running["fab1"], running["fab2"]
+		mutex.Unlock()
+		if fab1 == 0 && fab2 == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected only the loop of fab2 running, got fab1=%d fab2=%d", fab1, fab2)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloadInvalidTLS(t *testing.T) {
+	handler, configFile := newReloadTestHandler(t)
+	configDirName := "config.d"
+
+	writeReloadTestConfig(t, configFile, `
+fabrics:
+  fab1:
+    username: foo
+    password: bar
+    apic:
+      - https://127.0.0.1:1
+    tls:
+      ca_file: `+filepath.Join(t.TempDir(), "missing.pem")+`
+`)
+	err := handler.reload(&configDirName)
+	if err == nil {
+		t.Fatal("expected reload to fail on a missing ca file")
+	}
+	fabric, _ := handler.fabric("fab1")
+	if fabric.TLS.CAFile != "" || fabric.apicClient == nil {
+		t.Errorf("expected the loaded fabric and http client kept, got %+v", fabric.TLS)
+	}
+}
+
+func TestReloadInvalidAggregation(t *testing.T) {
+	handler, configFile := newReloadTestHandler(t)
+	configDirName := "config.d"
+
+	writeReloadTestConfig(t, configFile, `
+fabrics:
+  fab1:
+    username: foo
+    password: bar
+    apic:
+      - https://127.0.0.1:1
+class_queries:
+  tenants:
+    class_name: fvTenant
+    aggregation:
+      group_by: [tenant]
+    metrics:
+      - name: tenant
+        type: info
+`)
+	err := handler.reload(&configDirName)
+	if err == nil || !strings.Contains(err.Error(), "can not be aggregated") {
+		t.Fatalf("expected reload to fail on an aggregated info metric, got %v", err)
+	}
+	allQueries, _ := handler.queries()
+	if allQueries.ClassQueries["tenants"].Aggregation != nil {
+		t.Error("failed reload changed the class queries")
+	}
+}
+
+func TestReloadStopCollections(t *testing.T) {
+	handler, configFile := newReloadTestHandler(t)
+	configDirName := "config.d"
+	viper.Set("httpclient.retries", 0)
+	handler.scheduler = NewScheduler(handler, time.Hour, 0)
+
+	// The collection fail since there is no apic, but the job is created
+	_, _, _ = handler.scheduler.Get(context.Background(), "fab1", []string{"tenants"}, nil)
+	job := handler.scheduler.job("fab1", []string{"tenants"}, nil)
+	if job.interval != time.Hour {
+		t.Fatalf("expected the default interval, got %s", job.interval)
+	}
+
+	writeReloadTestConfig(t, configFile, strings.Replace(reloadTestConfig, "    password: bar\n",
+		"    password: bar\n    collection_interval: 30\n", 1))
+	err := handler.reload(&configDirName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.scheduler.mutex.Lock()
+	jobs := len(handler.scheduler.jobs)
+	handler.scheduler.mutex.Unlock()
+	if jobs != 0 {
+		t.Errorf("expected the collection of the changed fabric stopped, got %d collections", jobs)
+	}
+
+	job = handler.scheduler.job("fab1", []string{"tenants"}, nil)
+	if job.interval != 30*time.Second {
+		t.Errorf("expected the collection restarted with the reloaded interval, got %s", job.interval)
+	}
+}
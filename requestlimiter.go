@@ -0,0 +1,117 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spf13/viper"
+)
+
+var requestQueueWaitMetric = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    MetricsPrefix + "request_queue_wait_seconds",
+	Help:    "Histogram of the time (in seconds) requests waited for a free slot of max_inflight_requests.",
+	Buckets: []float64{0.001, 0.010, 0.050, 0.100, 0.500, 1.0, 2.0, 5.0, 10.0, 30.0},
+},
+	[]string{"fabric"},
+)
+
+var requestsInflightMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: MetricsPrefix + "requests_inflight",
+	Help: "Number of requests in flight to the apic and nodes of the fabric",
+},
+	[]string{"fabric"},
+)
+
+// maxInflightRequests return the max number of concurrent requests to the apic, or to a node, of the fabric. The
+// fabric setting override httpclient.max_inflight_requests, 0 is no limit.
+func (f *Fabric) maxInflightRequests() int {
+	if f.MaxInflightRequests > 0 {
+		return f.MaxInflightRequests
+	}
+	return viper.GetInt("httpclient.max_inflight_requests")
+}
+
+// requestLimiter is a http.RoundTripper that limit the number of concurrent requests of a connection. A request hold
+// its slot until the response body is closed, so the slot also cover the time the apic send the response.
+type requestLimiter struct {
+	transport  http.RoundTripper
+	slots      chan struct{}
+	fabricName string
+}
+
+// newRequestLimiter return the transport limited to max concurrent requests, or the transport if max is 0
+func newRequestLimiter(transport http.RoundTripper, max int, fabricName string) http.RoundTripper {
+	if max <= 0 {
+		return transport
+	}
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &requestLimiter{
+		transport:  transport,
+		slots:      make(chan struct{}, max),
+		fabricName: fabricName,
+	}
+}
+
+// unwrapTransport return the transport of a limited transport
+func unwrapTransport(transport http.RoundTripper) http.RoundTripper {
+	if limiter, ok := transport.(*requestLimiter); ok {
+		return limiter.transport
+	}
+	return transport
+}
+
+func (l *requestLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	select {
+	case l.slots <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	requestQueueWaitMetric.With(prometheus.Labels{LogFieldFabric: l.fabricName}).Observe(time.Since(start).Seconds())
+	requestsInflightMetric.With(prometheus.Labels{LogFieldFabric: l.fabricName}).Inc()
+
+	once := &sync.Once{}
+	release := func() {
+		once.Do(func() {
+			requestsInflightMetric.With(prometheus.Labels{LogFieldFabric: l.fabricName}).Dec()
+			<-l.slots
+		})
+	}
+
+	resp, err := l.transport.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releaseBody release the slot of the request when the response body is closed
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
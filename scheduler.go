@@ -0,0 +1,264 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var backgroundCollectionsMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: MetricsPrefix + "background_collections",
+	Help: "Number of active background collections",
+},
+	[]string{"fabric"},
+)
+
+// Scheduler collect metrics in the background and keep the latest result for every combination of fabric, queries
+// and node that has been requested on /probe. A collection is started by the first request and is stopped when it
+// has not been requested within the idle timeout.
+type Scheduler struct {
+	handler     *HandlerInit
+	interval    time.Duration
+	idleTimeout time.Duration
+	jobs        map[string]*collectionJob
+	mutex       sync.Mutex
+}
+
+type collectionJob struct {
+	key      string
+	fabric   string
+	queries  []string
+	node     *string
+	interval time.Duration
+	// cancel stop the collection
+	cancel context.CancelFunc
+	// ready is closed when the first collection is done
+	ready         chan struct{}
+	mutex         sync.RWMutex
+	aciName       string
+	metrics       []MetricDefinition
+	err           error
+	collected     time.Time
+	lastRequested time.Time
+}
+
+// NewScheduler create a scheduler where interval is the default interval between collections
+func NewScheduler(handler *HandlerInit, interval time.Duration, idleTimeout time.Duration) *Scheduler {
+	return &Scheduler{
+		handler:     handler,
+		interval:    interval,
+		idleTimeout: idleTimeout,
+		jobs:        make(map[string]*collectionJob),
+	}
+}
+
+// jobKey returns a unique name for the fabric, queries and node, the order of the queries is not significant
+func jobKey(fabric string, queries []string, node *string) string {
+	sorted := make([]string, len(queries))
+	copy(sorted, queries)
+	sort.Strings(sorted)
+	key := fabric + "|" + strings.Join(sorted, ",")
+	if node != nil {
+		key = key + "|" + *node
+	}
+	return key
+}
+
+// Get return the latest collected metrics, if no collection exists for the combination it is started and the first
+// collection is waited for
+func (s *Scheduler) Get(ctx context.Context, fabric string, queries []string, node *string) (string, []MetricDefinition, error) {
+	job := s.job(fabric, queries, node)
+
+	select {
+	case <-job.ready:
+	case <-ctx.Done():
+		return "", nil, ctx.Err()
+	}
+
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	job.lastRequested = time.Now()
+
+	// Copy to not modify the cached slice
+	metrics := make([]MetricDefinition, 0, len(job.metrics)+1)
+	metrics = append(metrics, job.metrics...)
+	metrics = append(metrics, *collectionAge(time.Since(job.collected).Seconds()))
+
+	log.WithFields(log.Fields{
+		LogFieldRequestID: ctx.Value(LogFieldRequestID),
+		LogFieldFabric:    fabric,
+		"age_seconds":     time.Since(job.collected).Seconds(),
+	}).Debug("return background collected metrics")
+
+	return job.aciName, metrics, job.err
+}
+
+func (s *Scheduler) job(fabric string, queries []string, node *string) *collectionJob {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := jobKey(fabric, queries, node)
+	job, ok := s.jobs[key]
+	if ok {
+		return job
+	}
+
+	interval := s.interval
+	if fabricConfig, ok := s.handler.fabric(fabric); ok && fabricConfig.CollectionInterval > 0 {
+		interval = time.Duration(fabricConfig.CollectionInterval) * time.Second
+	}
+
+	ctx, cancel := context.WithCancel(s.handler.ctx)
+	job = &collectionJob{
+		key:           key,
+		fabric:        fabric,
+		queries:       queries,
+		node:          node,
+		interval:      interval,
+		cancel:        cancel,
+		ready:         make(chan struct{}),
+		lastRequested: time.Now(),
+	}
+	s.jobs[key] = job
+	backgroundCollectionsMetric.With(prometheus.Labels{LogFieldFabric: fabric}).Inc()
+
+	log.WithFields(log.Fields{
+		LogFieldFabric: fabric,
+		"queries":      strings.Join(queries, ","),
+		"interval":     interval.Seconds(),
+	}).Info("start background collection")
+
+	started := s.handler.startLoop(func(context.Context) {
+		s.run(ctx, job)
+	})
+	if !started {
+		cancel()
+		job.err = fmt.Errorf("exporter is shutting down")
+		close(job.ready)
+	}
+	return job
+}
+
+func (s *Scheduler) run(ctx context.Context, job *collectionJob) {
+	ticker := time.NewTicker(job.interval)
+	defer ticker.Stop()
+
+	s.collect(ctx, job)
+	close(job.ready)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		job.mutex.RLock()
+		idle := time.Since(job.lastRequested)
+		job.mutex.RUnlock()
+
+		if s.idleTimeout > 0 && idle > s.idleTimeout {
+			s.mutex.Lock()
+			s.remove(job)
+			s.mutex.Unlock()
+
+			log.WithFields(log.Fields{
+				LogFieldFabric: job.fabric,
+				"queries":      strings.Join(job.queries, ","),
+				"idle":         idle.Seconds(),
+			}).Info("stop idle background collection")
+			return
+		}
+		s.collect(ctx, job)
+	}
+}
+
+// stopFabrics stop the collections of the fabrics, used on reload for removed and changed fabrics. A new collection,
+// with the configuration after the reload, is started by the next request.
+func (s *Scheduler) stopFabrics(fabrics []string) {
+	stop := make(map[string]bool, len(fabrics))
+	for _, fabricName := range fabrics {
+		stop[fabricName] = true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, job := range s.jobs {
+		if !stop[job.fabric] {
+			continue
+		}
+		s.remove(job)
+
+		log.WithFields(log.Fields{
+			LogFieldFabric: job.fabric,
+			"queries":      strings.Join(job.queries, ","),
+		}).Info("stop background collection of reloaded fabric")
+	}
+}
+
+// remove stop the job and remove it from the jobs, the scheduler mutex must be held
+func (s *Scheduler) remove(job *collectionJob) {
+	job.cancel()
+	if s.jobs[job.key] != job {
+		return
+	}
+	delete(s.jobs, job.key)
+	backgroundCollectionsMetric.With(prometheus.Labels{LogFieldFabric: job.fabric}).Dec()
+}
+
+func (s *Scheduler) collect(ctx context.Context, job *collectionJob) {
+	ctx = context.WithValue(ctx, LogFieldRequestID, nextRequestID())
+	ctx = context.WithValue(ctx, LogFieldFabric, job.fabric)
+
+	start := time.Now()
+	aciName, metrics, err := s.handler.collect(ctx, job.fabric, job.queries, job.node)
+	log.WithFields(log.Fields{
+		LogFieldRequestID: ctx.Value(LogFieldRequestID),
+		LogFieldExecTime:  time.Since(start).Microseconds(),
+		LogFieldFabric:    fmt.Sprintf("%v", ctx.Value(LogFieldFabric)),
+	}).Info("background query collection time")
+
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	job.aciName = aciName
+	job.metrics = metrics
+	job.err = err
+	job.collected = time.Now()
+}
+
+func collectionAge(seconds float64) *MetricDefinition {
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "collection_age"
+	metricDefinition.Description = MetricDesc{
+		Help: "The age, in seconds, of the background collected metrics",
+		Type: "gauge",
+		Unit: "seconds",
+	}
+	metricDefinition.Metrics = []Metric{}
+
+	metric := Metric{}
+	metric.Labels = make(map[string]string)
+	metric.Value = seconds
+
+	metricDefinition.Metrics = append(metricDefinition.Metrics, metric)
+
+	return &metricDefinition
+}
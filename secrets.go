@@ -0,0 +1,237 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
+)
+
+// SecretProvider return the key values of a secret, like the username and password of a fabric
+type SecretProvider interface {
+	Secret(ctx context.Context, path string) (map[string]string, error)
+}
+
+// secretProviders create the named provider from the secret_providers configuration
+var secretProviders = map[string]func() SecretProvider{
+	"vault":      newVaultProvider,
+	"kubernetes": newKubernetesProvider,
+}
+
+// secretCache keep the secrets of providers that are expensive to read, like vault, for the cache ttl
+var secretCache = struct {
+	sync.Mutex
+	entries map[string]secretCacheEntry
+}{entries: make(map[string]secretCacheEntry)}
+
+type secretCacheEntry struct {
+	values  map[string]string
+	expires time.Time
+}
+
+// clearSecretCache make sure the secrets are read again, e.g. on configuration reload or failed login
+func clearSecretCache() {
+	secretCache.Lock()
+	defer secretCache.Unlock()
+	secretCache.entries = make(map[string]secretCacheEntry)
+}
+
+// credentials return the username and password of the fabric. A secret provider take precedence over the files,
+// and the files over the username and password in the configuration. Files and providers are read on every login so
+// rotated credentials are used without restart.
+func (f *Fabric) credentials(ctx context.Context) (string, string, error) {
+	username := f.Username
+	password := f.Password
+
+	if f.Secret.Provider != "" {
+		newProvider, ok := secretProviders[f.Secret.Provider]
+		if !ok {
+			return "", "", fmt.Errorf("secret provider %s is not supported", f.Secret.Provider)
+		}
+		values, err := newProvider().Secret(ctx, f.Secret.Path)
+		if err != nil {
+			return "", "", fmt.Errorf("secret %s from %s - %s", f.Secret.Path, f.Secret.Provider, err)
+		}
+		usernameKey, passwordKey := f.Secret.keys()
+		if value, ok := values[usernameKey]; ok {
+			username = value
+		}
+		password, ok = values[passwordKey]
+		if !ok {
+			return "", "", fmt.Errorf("secret %s from %s has no key %s", f.Secret.Path, f.Secret.Provider,
+				passwordKey)
+		}
+		return username, password, nil
+	}
+
+	if f.UsernameFile != "" {
+		value, err := readSecretFile(f.UsernameFile)
+		if err != nil {
+			return "", "", err
+		}
+		username = value
+	}
+	if f.PasswordFile != "" {
+		value, err := readSecretFile(f.PasswordFile)
+		if err != nil {
+			return "", "", err
+		}
+		password = value
+	}
+	return username, password, nil
+}
+
+// keys return the keys of the username and password in the secret
+func (s FabricSecret) keys() (string, string) {
+	usernameKey := s.UsernameKey
+	if usernameKey == "" {
+		usernameKey = "username"
+	}
+	passwordKey := s.PasswordKey
+	if passwordKey == "" {
+		passwordKey = "password"
+	}
+	return usernameKey, passwordKey
+}
+
+// readSecretFile return the content of the file without any trailing newline
+func readSecretFile(fileName string) (string, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return "", fmt.Errorf("secret file not readable - %s", err)
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// kubernetesProvider read a secret mounted as a volume, where every key is a file in the directory of the path
+type kubernetesProvider struct{}
+
+func newKubernetesProvider() SecretProvider {
+	return &kubernetesProvider{}
+}
+
+func (k *kubernetesProvider) Secret(ctx context.Context, path string) (map[string]string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for _, entry := range entries {
+		// The mounted keys are symbolic links to the files of the latest version in the ..data directory
+		if strings.HasPrefix(entry.Name(), "..") || entry.IsDir() {
+			continue
+		}
+		value, err := readSecretFile(filepath.Join(path, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		values[entry.Name()] = value
+	}
+	return values, nil
+}
+
+// vaultProvider read a secret from the HashiCorp Vault KV secrets engine, version 1 or 2. The path is the api path
+// without /v1/, e.g. secret/data/aci/fabric for version 2.
+type vaultProvider struct {
+	address   string
+	token     string
+	tokenFile string
+	namespace string
+	cacheTTL  time.Duration
+	client    *http.Client
+}
+
+func newVaultProvider() SecretProvider {
+	return &vaultProvider{
+		address:   strings.TrimSuffix(viper.GetString("secret_providers.vault.address"), "/"),
+		token:     viper.GetString("secret_providers.vault.token"),
+		tokenFile: viper.GetString("secret_providers.vault.token_file"),
+		namespace: viper.GetString("secret_providers.vault.namespace"),
+		cacheTTL:  viper.GetDuration("secret_providers.vault.cache_ttl") * time.Second,
+		client:    &http.Client{Timeout: viper.GetDuration("secret_providers.vault.timeout") * time.Second},
+	}
+}
+
+func (v *vaultProvider) Secret(ctx context.Context, path string) (map[string]string, error) {
+	cacheKey := "vault:" + v.address + "/" + path
+	secretCache.Lock()
+	entry, ok := secretCache.entries[cacheKey]
+	secretCache.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.values, nil
+	}
+
+	token := v.token
+	if v.tokenFile != "" {
+		// The token file is typical written by the vault agent and may be rotated
+		value, err := readSecretFile(v.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = value
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/v1/%s", v.address,
+		strings.TrimPrefix(path, "/")), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault returned %d", resp.StatusCode)
+	}
+
+	// KV version 2 has the secret in data.data and version 1 in data
+	data := gjson.GetBytes(body, "data")
+	if data.Get("data").IsObject() && data.Get("metadata").Exists() {
+		data = data.Get("data")
+	}
+	values := make(map[string]string)
+	data.ForEach(func(key, value gjson.Result) bool {
+		values[key.String()] = value.String()
+		return true
+	})
+
+	secretCache.Lock()
+	secretCache.entries[cacheKey] = secretCacheEntry{values: values, expires: time.Now().Add(v.cacheTTL)}
+	secretCache.Unlock()
+
+	log.WithFields(log.Fields{
+		LogFieldRequestID: ctx.Value(LogFieldRequestID),
+		"path":            path,
+	}).Debug("secret read from vault")
+	return values, nil
+}
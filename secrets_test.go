@@ -0,0 +1,222 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// fakeVault serve KV version 1 and 2 secrets, and count the requests
+type fakeVault struct {
+	requests atomic.Int32
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests.Add(1)
+	if r.Header.Get("X-Vault-Token") != "vault-token" || r.Header.Get("X-Vault-Namespace") != "aci" {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+		return
+	}
+	switch r.URL.Path {
+	case "/v1/secret/data/aci/fab1":
+		_, _ = w.Write([]byte(`{"data":{"data":{"username":"kv2-user","password":"kv2-pw"},` +
+			`"metadata":{"version":3}}}`))
+	case "/v1/kv/aci/fab2":
+		_, _ = w.Write([]byte(`{"data":{"user":"kv1-user","pass":"kv1-pw"}}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"errors":[]}`))
+	}
+}
+
+func newSecretsTestVault(t *testing.T) *fakeVault {
+	t.Helper()
+	vault := &fakeVault{}
+	server := httptest.NewServer(vault)
+	t.Cleanup(server.Close)
+
+	SetDefaultValues()
+	viper.Set("secret_providers.vault.address", server.URL+"/")
+	viper.Set("secret_providers.vault.token", "vault-token")
+	viper.Set("secret_providers.vault.namespace", "aci")
+	clearSecretCache()
+	t.Cleanup(func() {
+		clearSecretCache()
+		viper.Reset()
+	})
+	return vault
+}
+
+func TestVaultCredentials(t *testing.T) {
+	tests := []struct {
+		name     string
+		secret   FabricSecret
+		username string
+		password string
+		err      bool
+	}{
+		{name: "kv version 2", secret: FabricSecret{Provider: "vault", Path: "secret/data/aci/fab1"},
+			username: "kv2-user", password: "kv2-pw"},
+		{name: "kv version 1 with keys", secret: FabricSecret{Provider: "vault", Path: "/kv/aci/fab2",
+			UsernameKey: "user", PasswordKey: "pass"}, username: "kv1-user", password: "kv1-pw"},
+		{name: "missing password key", secret: FabricSecret{Provider: "vault", Path: "kv/aci/fab2"}, err: true},
+		{name: "missing secret", secret: FabricSecret{Provider: "vault", Path: "kv/aci/unknown"}, err: true},
+		{name: "unsupported provider", secret: FabricSecret{Provider: "aws", Path: "aci"}, err: true},
+	}
+
+	newSecretsTestVault(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fabric := &Fabric{Username: "config-user", Password: "config-pw", Secret: test.secret}
+			username, password, err := fabric.credentials(context.Background())
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error, got %s %s", username, password)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if username != test.username || password != test.password {
+				t.Errorf("expected %s %s, got %s %s", test.username, test.password, username, password)
+			}
+		})
+	}
+}
+
+func TestVaultTokenAndCache(t *testing.T) {
+	vault := newSecretsTestVault(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	err := os.WriteFile(tokenFile, []byte("wrong-token\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("secret_providers.vault.token_file", tokenFile)
+
+	fabric := &Fabric{Secret: FabricSecret{Provider: "vault", Path: "secret/data/aci/fab1"}}
+	_, _, err = fabric.credentials(context.Background())
+	if err == nil {
+		t.Fatal("expected the token file to override the token")
+	}
+
+	// The rotated token is read on the next login
+	err = os.WriteFile(tokenFile, []byte("vault-token\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		_, password, err := fabric.credentials(context.Background())
+		if err != nil || password != "kv2-pw" {
+			t.Fatalf("expected password from vault, got %s %v", password, err)
+		}
+	}
+	if vault.requests.Load() != 2 {
+		t.Errorf("expected the secret to be cached, got %d requests", vault.requests.Load())
+	}
+
+	clearSecretCache()
+	_, _, _ = fabric.credentials(context.Background())
+	if vault.requests.Load() != 3 {
+		t.Errorf("expected the secret to be read after the cache is cleared, got %d requests", vault.requests.Load())
+	}
+}
+
+func TestFileAndKubernetesCredentials(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name string, content string) string {
+		fileName := filepath.Join(dir, name)
+		if err := os.WriteFile(fileName, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return fileName
+	}
+	passwordFile := writeFile("password", "file-pw\r\n")
+
+	fabric := &Fabric{Username: "config-user", Password: "config-pw", PasswordFile: passwordFile}
+	username, password, err := fabric.credentials(context.Background())
+	if err != nil || username != "config-user" || password != "file-pw" {
+		t.Errorf("expected config-user file-pw, got %s %s %v", username, password, err)
+	}
+
+	fabric.UsernameFile = filepath.Join(dir, "missing")
+	if _, _, err = fabric.credentials(context.Background()); err == nil {
+		t.Errorf("expected an error for a missing username file")
+	}
+
+	secretDir := filepath.Join(dir, "secret")
+	if err = os.MkdirAll(filepath.Join(secretDir, "..data"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeFile("secret/username", "k8s-user\n")
+	writeFile("secret/password", "k8s-pw")
+	writeFile("secret/..data/password", "ignored")
+
+	fabric.Secret = FabricSecret{Provider: "kubernetes", Path: secretDir}
+	username, password, err = fabric.credentials(context.Background())
+	if err != nil || username != "k8s-user" || password != "k8s-pw" {
+		t.Errorf("expected k8s-user k8s-pw, got %s %s %v", username, password, err)
+	}
+}
+
+func TestLoginBodyEscaped(t *testing.T) {
+	password := `p"w\d`
+	logins := make(chan string, 2)
+	mux := http.NewServeMux()
+	handle := func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			AaaUser struct {
+				Attributes map[string]string `json:"attributes"`
+			} `json:"aaaUser"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		logins <- body.AaaUser.Attributes["pwd"]
+		_, _ = w.Write([]byte(`{"totalCount":"1","imdata":[{"aaaLogin":{"attributes":{"token":"login-token",` +
+			`"refreshTimeoutSeconds":"600","maximumLifetimeSeconds":"86400"}}}]}`))
+	}
+	mux.HandleFunc("/api/aaaLogin.json", handle)
+	mux.HandleFunc("/api/aaaLogout.json", handle)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	SetDefaultValues()
+	t.Cleanup(viper.Reset)
+
+	con := newAciConnection(&Fabric{FabricName: "escaped", Username: "admin", Password: password,
+		Apic: []string{server.URL}}, nil)
+	if err := con.login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if pwd := <-logins; pwd != password {
+		t.Errorf("expected password %q, got %q", password, pwd)
+	}
+
+	if err := con.logout(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if pwd := <-logins; pwd != "" {
+		t.Errorf("expected logout without password, got %q", pwd)
+	}
+}
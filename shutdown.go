@@ -0,0 +1,112 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// startCollection register a new collection, false if the exporter is shutting down
+func (h *HandlerInit) startCollection() bool {
+	h.shutdownMutex.RLock()
+	defer h.shutdownMutex.RUnlock()
+	if h.shutdown {
+		return false
+	}
+	h.collections.Add(1)
+	return true
+}
+
+// startLoop run the background loop with the root context, false if the exporter is shutting down. The loop must
+// return when the context is done.
+func (h *HandlerInit) startLoop(loop func(ctx context.Context)) bool {
+	h.shutdownMutex.RLock()
+	defer h.shutdownMutex.RUnlock()
+	if h.shutdown {
+		return false
+	}
+	h.loops.Add(1)
+	go func() {
+		defer h.loops.Done()
+		loop(h.ctx)
+	}()
+	return true
+}
+
+// withRootContext return the context that is also cancelled when the exporter is shut down
+func (h *HandlerInit) withRootContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-h.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// shutdownOnSignal shutdown the exporter on SIGTERM or SIGINT. No new requests are accepted and the executing requests
+// are waited for up to httpserver.shutdown_timeout seconds. Then the background loops and any executing collections
+// are stopped, and all sessions are logged out before stopped is closed.
+func (h *HandlerInit) shutdownOnSignal(server *http.Server, stopped chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+
+	timeout := viper.GetDuration("httpserver.shutdown_timeout") * time.Second
+	log.WithFields(log.Fields{
+		"signal":           sig.String(),
+		"shutdown_timeout": timeout.Seconds(),
+	}).Info("Received signal, shutdown")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Stop accepting requests and wait for the executing requests
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Warning("shutdown timeout reached, executing scrapes are aborted - ", err)
+	}
+
+	h.stop(timeout)
+	logoutAllConnections()
+	close(stopped)
+}
+
+// stop the background loops and abort the executing collections, and wait for them to return
+func (h *HandlerInit) stop(timeout time.Duration) {
+	h.shutdownMutex.Lock()
+	h.shutdown = true
+	h.shutdownMutex.Unlock()
+	h.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		h.loops.Wait()
+		h.collections.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Warning("background loops and collections not stopped within the shutdown timeout")
+	}
+}
@@ -0,0 +1,506 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
+	"golang.org/x/net/websocket"
+)
+
+// subscriptionStore is set if subscriptions are enabled, class queries with subscription are read from the store
+var subscriptionStore *StateStore
+
+var subscriptionsMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: MetricsPrefix + "subscriptions",
+	Help: "Number of active subscriptions",
+},
+	[]string{"fabric"},
+)
+
+var subscriptionEventsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: MetricsPrefix + "subscription_events",
+	Help: "Number of object changes received on subscriptions",
+},
+	[]string{"fabric", "class"},
+)
+
+var subscriptionFailedMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: MetricsPrefix + "subscription_failed",
+	Help: "Number of failed subscribes, refreshes and closed websockets",
+},
+	[]string{"fabric"},
+)
+
+// StateStore hold the objects of the subscribed class queries per fabric, updated by the subscription events
+type StateStore struct {
+	mutex sync.RWMutex
+	// fabric -> query name -> state
+	states map[string]map[string]*classState
+}
+
+type classState struct {
+	class string
+	// dn -> attributes
+	objects map[string]map[string]string
+}
+
+func NewStateStore() *StateStore {
+	return &StateStore{states: make(map[string]map[string]*classState)}
+}
+
+// sync replace the objects of the query with the imdata of the subscribe response
+func (s *StateStore) sync(fabricName string, queryName string, class string, imdata gjson.Result) {
+	state := &classState{class: class, objects: make(map[string]map[string]string)}
+	imdata.ForEach(func(key, value gjson.Result) bool {
+		attributes := make(map[string]string)
+		value.Get(class + ".attributes").ForEach(func(k, v gjson.Result) bool {
+			attributes[k.String()] = v.String()
+			return true
+		})
+		if dn, ok := attributes["dn"]; ok {
+			state.objects[dn] = attributes
+		}
+		return true
+	})
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.states[fabricName]; !ok {
+		s.states[fabricName] = make(map[string]*classState)
+	}
+	s.states[fabricName][queryName] = state
+}
+
+// apply a created, modified or deleted event on the object. A modified event only include the changed attributes.
+func (s *StateStore) apply(fabricName string, queryName string, attributes map[string]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state, ok := s.states[fabricName][queryName]
+	if !ok {
+		return
+	}
+
+	dn := attributes["dn"]
+	status := attributes["status"]
+	delete(attributes, "status")
+	switch status {
+	case "deleted":
+		delete(state.objects, dn)
+	case "created":
+		state.objects[dn] = attributes
+	default:
+		object, ok := state.objects[dn]
+		if !ok {
+			state.objects[dn] = attributes
+			return
+		}
+		for k, v := range attributes {
+			object[k] = v
+		}
+	}
+}
+
+// clear remove all states of the fabric, the queries are polled until subscribed again
+func (s *StateStore) clear(fabricName string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.states, fabricName)
+}
+
+// data return the objects of the query in the same format as a class query response
+func (s *StateStore) data(fabricName string, queryName string) (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	state, ok := s.states[fabricName][queryName]
+	if !ok {
+		return "", false
+	}
+
+	dns := make([]string, 0, len(state.objects))
+	for dn := range state.objects {
+		dns = append(dns, dn)
+	}
+	sort.Strings(dns)
+
+	imdata := make([]map[string]map[string]map[string]string, 0, len(dns))
+	for _, dn := range dns {
+		imdata = append(imdata, map[string]map[string]map[string]string{
+			state.class: {"attributes": state.objects[dn]},
+		})
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"totalCount": strconv.Itoa(len(imdata)),
+		"imdata":     imdata,
+	})
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+// Subscriber subscribe to the class queries with subscription set on a fabric. The events are received on the apic
+// websocket and applied to the state store. The subscriptions are refreshed with the token of the connection.
+type Subscriber struct {
+	handler         *HandlerInit
+	fabricName      string
+	store           *StateStore
+	refreshInterval time.Duration
+	retryInterval   time.Duration
+
+	mutex  sync.Mutex
+	con    *AciConnection
+	socket *websocket.Conn
+	// lifetime of the token the websocket was opened with, a new login require a new websocket
+	lifetime int64
+	// subscription id -> query name
+	ids         map[string]string
+	queries     ClassQueries
+	lastRefresh time.Time
+}
+
+// StartSubscriptions start a subscriber for every configured fabric, also for fabrics added by a reload
+func StartSubscriptions(handler *HandlerInit) {
+	subscriptionStore = NewStateStore()
+
+	refreshInterval := viper.GetDuration("subscriptions.refresh_interval") * time.Second
+	retryInterval := viper.GetDuration("subscriptions.retry_interval") * time.Second
+	handler.startFabricLoops("subscriptions", viper.GetStringSlice("subscriptions.fabrics"),
+		func(ctx context.Context, fabricName string) {
+			subscriber := &Subscriber{
+				handler:         handler,
+				fabricName:      fabricName,
+				store:           subscriptionStore,
+				refreshInterval: refreshInterval,
+				retryInterval:   retryInterval,
+			}
+			log.WithFields(log.Fields{
+				LogFieldFabric:     fabricName,
+				"refresh_interval": subscriber.refreshInterval.Seconds(),
+			}).Info("start subscriptions")
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				subscriber.keepAlive(ctx)
+			}()
+			subscriber.run(ctx)
+			wg.Wait()
+		})
+}
+
+// subscribedQueries return the class queries with subscription set
+func (s *Subscriber) subscribedQueries() ClassQueries {
+	allQueries, _ := s.handler.queries()
+	queries := ClassQueries{}
+	for name, query := range allQueries.ClassQueries {
+		if query.Subscription {
+			queries[name] = query
+		}
+	}
+	return queries
+}
+
+// run connect and receive events until the websocket is closed, then connect again after the retry interval. The
+// websocket is closed when the context is done.
+func (s *Subscriber) run(rootCtx context.Context) {
+	go func() {
+		<-rootCtx.Done()
+		s.close()
+	}()
+
+	for rootCtx.Err() == nil {
+		ctx := context.WithValue(rootCtx, LogFieldRequestID, nextRequestID())
+		ctx = context.WithValue(ctx, LogFieldFabric, s.fabricName)
+
+		socket, err := s.connect(ctx)
+		if err != nil {
+			subscriptionFailedMetric.With(prometheus.Labels{LogFieldFabric: s.fabricName}).Inc()
+			log.WithFields(log.Fields{
+				LogFieldRequestID: ctx.Value(LogFieldRequestID),
+				LogFieldFabric:    s.fabricName,
+			}).Warning("subscribe failed - ", err)
+		} else if socket != nil {
+			s.receive(socket)
+		}
+
+		s.close()
+		sleepContext(rootCtx, s.retryInterval)
+	}
+}
+
+// connect login, open the websocket and subscribe to all queries. The websocket is opened before the subscribe so no
+// events are lost, and the events are not read until all subscriptions are stored.
+func (s *Subscriber) connect(ctx context.Context) (*websocket.Conn, error) {
+	queries := s.subscribedQueries()
+	if len(queries) == 0 {
+		return nil, nil
+	}
+
+	fabricConfig, ok := s.handler.fabric(s.fabricName)
+	if !ok {
+		return nil, fmt.Errorf("fabric do not exists")
+	}
+	if fabricConfig.PrivateKeyFile != "" {
+		return nil, fmt.Errorf("subscriptions require username and password authentication")
+	}
+
+	con := newAciConnection(fabricConfig, nil)
+	err := con.login(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	con.tokenMutex.Lock()
+	token := *con.token.Load()
+	controller := con.controller()
+	con.subscriber = s
+	con.tokenMutex.Unlock()
+
+	config, err := websocket.NewConfig(
+		strings.Replace(strings.Replace(controller, "https://", "wss://", 1), "http://", "ws://", 1)+
+			"/socket"+token.token, controller)
+	if err != nil {
+		return nil, err
+	}
+	if transport, ok := unwrapTransport(con.Client.Transport).(*http.Transport); ok && transport.TLSClientConfig != nil {
+		config.TlsConfig = transport.TLSClientConfig.Clone()
+	}
+	config.Dialer = &net.Dialer{Timeout: time.Duration(viper.GetInt("httpclient.timeout")) * time.Second}
+
+	socket, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// The subscribe requests are done without the subscriber locked, since a request may need a new login
+	ids := make(map[string]string)
+	responses := make(map[string]string)
+	for name, query := range queries {
+		data, err := con.GetByClassQuery(ctx, query.ClassName, subscriptionQueryParameter(query.QueryParameter))
+		if err != nil {
+			_ = socket.Close()
+			return nil, err
+		}
+		id := gjson.Get(data, "subscriptionId").String()
+		if id == "" {
+			_ = socket.Close()
+			return nil, fmt.Errorf("no subscription id returned for %s, paging with order-by is not supported", name)
+		}
+		ids[id] = name
+		responses[name] = data
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if ctx.Err() != nil {
+		// Stopped while subscribing, the websocket would not be closed by the stop
+		_ = socket.Close()
+		return nil, ctx.Err()
+	}
+	s.con = con
+	s.socket = socket
+	s.lifetime = token.lifetime
+	s.ids = ids
+	s.queries = queries
+	s.lastRefresh = time.Now()
+	for name, data := range responses {
+		s.store.sync(s.fabricName, name, queries[name].ClassName, gjson.Get(data, "imdata"))
+	}
+
+	subscriptionsMetric.With(prometheus.Labels{LogFieldFabric: s.fabricName}).Set(float64(len(s.ids)))
+	log.WithFields(log.Fields{
+		LogFieldRequestID: ctx.Value(LogFieldRequestID),
+		LogFieldFabric:    s.fabricName,
+		"subscriptions":   len(s.ids),
+	}).Info("subscribed")
+	return socket, nil
+}
+
+// subscriptionQueryParameter add subscription=yes to the query parameter
+func subscriptionQueryParameter(queryParameter string) string {
+	if queryParameter == "" {
+		return "?subscription=yes"
+	}
+	return queryParameter + "&subscription=yes"
+}
+
+// receive apply the events on the websocket to the store until the websocket is closed
+func (s *Subscriber) receive(socket *websocket.Conn) {
+	for {
+		var message string
+		err := websocket.Message.Receive(socket, &message)
+		if err != nil {
+			subscriptionFailedMetric.With(prometheus.Labels{LogFieldFabric: s.fabricName}).Inc()
+			log.WithFields(log.Fields{
+				LogFieldFabric: s.fabricName,
+			}).Warning("websocket closed - ", err)
+			return
+		}
+		s.apply(message)
+	}
+}
+
+// apply the objects of the event to the queries of the subscription ids
+func (s *Subscriber) apply(message string) {
+	s.mutex.Lock()
+	var queryNames []string
+	for _, id := range gjson.Get(message, "subscriptionId").Array() {
+		if name, ok := s.ids[id.String()]; ok {
+			queryNames = append(queryNames, name)
+		}
+	}
+	queries := s.queries
+	s.mutex.Unlock()
+
+	gjson.Get(message, "imdata").ForEach(func(key, value gjson.Result) bool {
+		value.ForEach(func(class, object gjson.Result) bool {
+			subscriptionEventsMetric.With(prometheus.Labels{LogFieldFabric: s.fabricName, "class": class.String()}).Inc()
+			for _, name := range queryNames {
+				if queries[name].ClassName != class.String() {
+					continue
+				}
+				attributes := make(map[string]string)
+				object.Get("attributes").ForEach(func(k, v gjson.Result) bool {
+					attributes[k.String()] = v.String()
+					return true
+				})
+				s.store.apply(s.fabricName, name, attributes)
+			}
+			return true
+		})
+		return true
+	})
+}
+
+// close the websocket and clear the store, the queries are polled until subscribed again
+func (s *Subscriber) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closeSocket()
+}
+
+func (s *Subscriber) closeSocket() {
+	if s.socket != nil {
+		_ = s.socket.Close()
+		s.socket = nil
+	}
+	s.ids = nil
+	s.store.clear(s.fabricName)
+	subscriptionsMetric.With(prometheus.Labels{LogFieldFabric: s.fabricName}).Set(0)
+}
+
+// keepAlive make sure the token and the subscriptions are refreshed even if the fabric is not scraped. The websocket
+// is closed and opened again if the connection or the subscribed queries are changed by a reload.
+func (s *Subscriber) keepAlive(rootCtx context.Context) {
+	ticker := time.NewTicker(s.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rootCtx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.mutex.Lock()
+		con := s.con
+		active := s.socket != nil
+		changed := !reflect.DeepEqual(s.queries, s.subscribedQueries())
+		s.mutex.Unlock()
+		if !active {
+			continue
+		}
+
+		fabricConfig, ok := s.handler.fabric(s.fabricName)
+		if !ok || changed || newAciConnection(fabricConfig, nil) != con {
+			log.WithFields(log.Fields{
+				LogFieldFabric: s.fabricName,
+			}).Info("subscribed queries or fabric changed, subscribe again")
+			s.close()
+			continue
+		}
+
+		ctx := context.WithValue(rootCtx, LogFieldRequestID, nextRequestID())
+		ctx = context.WithValue(ctx, LogFieldFabric, s.fabricName)
+		// The subscriptions are refreshed by the token processing
+		err := con.login(ctx)
+		if err != nil {
+			log.WithFields(log.Fields{
+				LogFieldRequestID: ctx.Value(LogFieldRequestID),
+				LogFieldFabric:    s.fabricName,
+			}).Warning("subscription login failed - ", err)
+		}
+	}
+}
+
+// refresh the subscriptions if not refreshed in the last half refresh interval. Must not be called with the token mutex
+// of the connection locked, since the subscriber is locked while subscribing and a subscribe may need a new login.
+func (s *Subscriber) refresh(ctx context.Context, c *AciConnection) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.socket == nil || c != s.con || time.Since(s.lastRefresh) < s.refreshInterval/2 {
+		return
+	}
+
+	// A new login invalidate the websocket, the refresh of the token keep it
+	if token := c.token.Load(); token == nil || token.lifetime != s.lifetime {
+		log.WithFields(log.Fields{
+			LogFieldRequestID: ctx.Value(LogFieldRequestID),
+			LogFieldFabric:    s.fabricName,
+		}).Info("new login, subscribe again")
+		s.closeSocket()
+		return
+	}
+
+	for id, name := range s.ids {
+		_, _, err := c.get(ctx, "subscriptionRefresh", fmt.Sprintf("%s/api/subscriptionRefresh.json?id=%s",
+			c.controller(), id))
+		if err != nil {
+			subscriptionFailedMetric.With(prometheus.Labels{LogFieldFabric: s.fabricName}).Inc()
+			log.WithFields(log.Fields{
+				LogFieldRequestID: ctx.Value(LogFieldRequestID),
+				LogFieldFabric:    s.fabricName,
+				"query":           name,
+			}).Warning("subscription refresh failed, subscribe again - ", err)
+			s.closeSocket()
+			return
+		}
+	}
+	s.lastRefresh = time.Now()
+}
+
+// refreshSubscriptions refresh the subscriptions if the connection is used by a subscriber
+func (c *AciConnection) refreshSubscriptions(ctx context.Context) {
+	c.tokenMutex.Lock()
+	subscriber := c.subscriber
+	c.tokenMutex.Unlock()
+	if subscriber != nil {
+		subscriber.refresh(ctx, c)
+	}
+}
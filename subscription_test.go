@@ -0,0 +1,210 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
+	"golang.org/x/net/websocket"
+)
+
+const testSubscriptionToken = "subscription-token"
+
+// fakeSubscriptionApic is an apic that answer subscribe requests and send the events on the websocket
+type fakeSubscriptionApic struct {
+	events     chan string
+	subscribed chan string
+}
+
+func (f *fakeSubscriptionApic) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/aaaLogin.json", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"totalCount":"1","imdata":[{"aaaLogin":{"attributes":{"token":"%s",`+
+			`"refreshTimeoutSeconds":"600","maximumLifetimeSeconds":"86400"}}}]}`, testSubscriptionToken)
+	})
+	mux.HandleFunc("/api/class/fvTenant.json", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("subscription") != "yes" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.subscribed <- r.URL.RawQuery
+		_, _ = w.Write([]byte(`{"totalCount":"2","subscriptionId":"72057594037927937","imdata":[` +
+			`{"fvTenant":{"attributes":{"dn":"uni/tn-common","name":"common","descr":""}}},` +
+			`{"fvTenant":{"attributes":{"dn":"uni/tn-mgmt","name":"mgmt","descr":""}}}]}`))
+	})
+	mux.Handle("/socket"+testSubscriptionToken, websocket.Handler(func(socket *websocket.Conn) {
+		for event := range f.events {
+			if websocket.Message.Send(socket, event) != nil {
+				return
+			}
+		}
+	}))
+	return mux
+}
+
+func newSubscriptionTestSubscriber(t *testing.T) (*Subscriber, *fakeSubscriptionApic) {
+	t.Helper()
+	apic := &fakeSubscriptionApic{events: make(chan string, 10), subscribed: make(chan string, 10)}
+	server := httptest.NewServer(apic.handler())
+	t.Cleanup(server.Close)
+
+	SetDefaultValues()
+	t.Cleanup(func() {
+		close(apic.events)
+		removeConnections("sub")
+		viper.Reset()
+	})
+
+	queries := AllQueries{ClassQueries: ClassQueries{
+		"tenants": &ClassQuery{ClassName: "fvTenant", QueryParameter: "?query-target=self", Subscription: true},
+		"polled":  &ClassQuery{ClassName: "fvCEp"},
+	}}
+	fabrics := map[string]*Fabric{"sub": {FabricName: "sub", Username: "admin", Password: "pw", Apic: []string{server.URL}}}
+	handler := NewHandlerInit(queries, fabrics)
+
+	return &Subscriber{
+		handler:         handler,
+		fabricName:      "sub",
+		store:           NewStateStore(),
+		refreshInterval: time.Minute,
+		retryInterval:   time.Second,
+	}, apic
+}
+
+// waitForData wait until the data of the query in the store match
+func waitForData(t *testing.T, store *StateStore, queryName string, match func(data string) bool) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := store.data("sub", queryName)
+		if match(data) {
+			return data
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("store not updated, got %s", data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSubscriber(t *testing.T) {
+	subscriber, apic := newSubscriptionTestSubscriber(t)
+
+	ctx := context.WithValue(context.Background(), LogFieldFabric, "sub")
+	socket, err := subscriber.connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if socket == nil {
+		t.Fatal("expected a websocket")
+	}
+	if query := <-apic.subscribed; query != "query-target=self&subscription=yes" {
+		t.Errorf("unexpected subscribe query %s", query)
+	}
+
+	data, ok := subscriber.store.data("sub", "tenants")
+	if !ok || gjson.Get(data, "totalCount").String() != "2" {
+		t.Fatalf("expected the subscribe response in the store, got %s", data)
+	}
+	if _, ok := subscriber.store.data("sub", "polled"); ok {
+		t.Errorf("query without subscription should not be in the store")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		subscriber.receive(socket)
+		close(done)
+	}()
+
+	apic.events <- `{"subscriptionId":["72057594037927937"],"imdata":[` +
+		`{"fvTenant":{"attributes":{"dn":"uni/tn-mgmt","descr":"changed","status":"modified"}}},` +
+		`{"fvTenant":{"attributes":{"dn":"uni/tn-infra","name":"infra","descr":"","status":"created"}}},` +
+		`{"fvTenant":{"attributes":{"dn":"uni/tn-common","status":"deleted"}}}]}`
+	data = waitForData(t, subscriber.store, "tenants", func(data string) bool {
+		return strings.Contains(data, "uni/tn-infra")
+	})
+	if gjson.Get(data, "totalCount").String() != "2" {
+		t.Errorf("expected 2 objects after the events, got %s", data)
+	}
+	if gjson.Get(data, `imdata.#(fvTenant.attributes.dn=="uni/tn-mgmt").fvTenant.attributes.descr`).String() != "changed" ||
+		gjson.Get(data, `imdata.#(fvTenant.attributes.dn=="uni/tn-mgmt").fvTenant.attributes.name`).String() != "mgmt" {
+		t.Errorf("expected modified event to update only the changed attributes, got %s", data)
+	}
+
+	// Events of other subscriptions are ignored
+	apic.events <- `{"subscriptionId":["1"],"imdata":[{"fvTenant":{"attributes":{"dn":"uni/tn-other","status":"created"}}}]}`
+	apic.events <- `{"subscriptionId":["72057594037927937"],"imdata":[{"fvTenant":{"attributes":{"dn":"uni/tn-last","status":"created"}}}]}`
+	data = waitForData(t, subscriber.store, "tenants", func(data string) bool {
+		return strings.Contains(data, "uni/tn-last")
+	})
+	if strings.Contains(data, "uni/tn-other") {
+		t.Errorf("event of unknown subscription applied, got %s", data)
+	}
+
+	subscriber.close()
+	<-done
+	if _, ok := subscriber.store.data("sub", "tenants"); ok {
+		t.Errorf("expected the store to be cleared when the subscription is closed")
+	}
+}
+
+func TestSubscriberStop(t *testing.T) {
+	subscriber, _ := newSubscriptionTestSubscriber(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		subscriber.run(ctx)
+		close(stopped)
+	}()
+	waitForData(t, subscriber.store, "tenants", func(data string) bool {
+		return data != ""
+	})
+
+	// The websocket is closed when the context is done, so the receive of events return
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscriber not stopped when the context was done")
+	}
+	if _, ok := subscriber.store.data("sub", "tenants"); ok {
+		t.Errorf("expected the store to be cleared when the subscriber is stopped")
+	}
+}
+
+func TestSubscriberNoQueries(t *testing.T) {
+	subscriber, _ := newSubscriptionTestSubscriber(t)
+	subscriber.handler.AllQueries.ClassQueries["tenants"].Subscription = false
+
+	socket, err := subscriber.connect(context.Background())
+	if err != nil || socket != nil {
+		t.Errorf("expected no websocket without subscribed queries, got %v %v", socket, err)
+	}
+}
+
+func TestSubscriptionQueryParameter(t *testing.T) {
+	if subscriptionQueryParameter("") != "?subscription=yes" {
+		t.Errorf("unexpected query parameter %s", subscriptionQueryParameter(""))
+	}
+	if subscriptionQueryParameter("?query-target=self") != "?query-target=self&subscription=yes" {
+		t.Errorf("unexpected query parameter %s", subscriptionQueryParameter("?query-target=self"))
+	}
+}
@@ -0,0 +1,528 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Knetic/govaluate"
+	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
+)
+
+// Prometheus naming rules, https://prometheus.io/docs/concepts/data_model/#metric-names-and-labels
+var metricNameRegex = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+var labelNameRegex = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+var validMetricTypes = map[string]bool{
+	"":                  true,
+	"gauge":             true,
+	"counter":           true,
+	"untyped":           true,
+	MetricTypeHistogram: true,
+	MetricTypeSummary:   true,
+	MetricTypeInfo:      true,
+}
+
+// configValidator collect the errors and warnings found in the queries
+type configValidator struct {
+	prefix   string
+	errors   []string
+	warnings []string
+}
+
+func (v *configValidator) errorf(query string, format string, a ...interface{}) {
+	v.errors = append(v.errors, fmt.Sprintf("%s: %s", query, fmt.Sprintf(format, a...)))
+}
+
+func (v *configValidator) warningf(query string, format string, a ...interface{}) {
+	v.warnings = append(v.warnings, fmt.Sprintf("%s: %s", query, fmt.Sprintf(format, a...)))
+}
+
+// validateConfiguration validate all queries and, if dataDir is set, run the class and group queries against the
+// saved responses in the directory. The result is written to stdout and the returned value is the exit code.
+func validateConfiguration(allQueries AllQueries, dataDir string) int {
+	validator := &configValidator{prefix: viper.GetString("prefix")}
+	validator.validateQueries(allQueries)
+
+	if dataDir != "" {
+		validator.dryRun(allQueries, dataDir)
+	}
+
+	for _, warning := range validator.warnings {
+		fmt.Printf("WARNING %s\n", warning)
+	}
+	for _, err := range validator.errors {
+		fmt.Printf("ERROR %s\n", err)
+	}
+
+	if len(validator.errors) > 0 {
+		fmt.Printf("Configuration is not valid, %d errors\n", len(validator.errors))
+		return 1
+	}
+	fmt.Printf("Configuration is valid, %d class queries, %d compound queries, %d group class queries\n",
+		len(allQueries.ClassQueries), len(allQueries.CompoundClassQueries), len(allQueries.GroupClassQueries))
+	return 0
+}
+
+func (v *configValidator) validateQueries(allQueries AllQueries) {
+	// The query names must be unique over all query types since they are used in the queries parameter
+	names := make(map[string]int)
+	for name := range allQueries.ClassQueries {
+		names[name]++
+	}
+	for name := range allQueries.CompoundClassQueries {
+		names[name]++
+	}
+	for name := range allQueries.GroupClassQueries {
+		names[name]++
+	}
+	for name, count := range names {
+		if count > 1 {
+			v.errorf(name, "query name is defined %d times in different query types", count)
+		}
+		if name == "faults" || name == "fault_instances" {
+			v.errorf(name, "query name is reserved for the built-in query")
+		}
+	}
+
+	for _, name := range sortedKeys(allQueries.ClassQueries) {
+		v.validateClassQuery(name, allQueries.ClassQueries[name], false)
+	}
+
+	for _, name := range sortedKeys(allQueries.CompoundClassQueries) {
+		query := allQueries.CompoundClassQueries[name]
+		if len(query.Metrics) == 0 {
+			v.errorf(name, "compound query must have a metric")
+		}
+		// The value name of the classes override the value name of the metrics
+		classValueNames := len(query.ClassNames) > 0
+		for _, classLabel := range query.ClassNames {
+			if classLabel.ValueName == "" {
+				classValueNames = false
+			}
+		}
+		for _, mv := range query.Metrics {
+			if classValueNames {
+				mv.ValueName = query.ClassNames[0].ValueName
+			}
+			if mv.Type == MetricTypeInfo {
+				v.errorf(name, "metric %s type info is only supported for class queries", mv.Name)
+			}
+			v.validateMetric(name, mv, false)
+		}
+		if !labelNameRegex.MatchString(query.LabelName) {
+			v.errorf(name, "labelname %q is not a valid label name", query.LabelName)
+		}
+		for _, classLabel := range query.ClassNames {
+			if classLabel.Class == "" {
+				v.errorf(name, "class_name must be set")
+			}
+		}
+		v.validateLimits(name, query.Limits)
+		v.validateRelabelConfigs(name, query.RelabelConfigs)
+	}
+
+	for _, name := range sortedKeys(allQueries.GroupClassQueries) {
+		query := allQueries.GroupClassQueries[name]
+		v.validateMetricName(name, query.Name, query.Unit, query.Type)
+		if len(query.Queries) == 0 {
+			v.errorf(name, "group class query must have queries")
+		}
+		for i := range query.Queries {
+			v.validateClassQuery(fmt.Sprintf("%s.queries[%d]", name, i), &query.Queries[i], true)
+			for _, mv := range query.Queries[i].Metrics {
+				if (query.Type == MetricTypeInfo) != (mv.Type == MetricTypeInfo) {
+					v.errorf(fmt.Sprintf("%s.queries[%d]", name, i),
+						"metric %s must have type info if and only if the group has type info", mv.Name)
+				}
+			}
+		}
+		v.validateStaticLabels(name, query.StaticLabels)
+		v.validateLimits(name, query.Limits)
+		v.validateRelabelConfigs(name, query.RelabelConfigs)
+	}
+
+	v.validateRelabelConfigs("relabel_configs", allQueries.RelabelConfigs)
+}
+
+// validateClassQuery validate the class query, for queries of a group the metric name is given by the group
+func (v *configValidator) validateClassQuery(name string, query *ClassQuery, group bool) {
+	if query.ClassName == "" {
+		v.errorf(name, "class_name must be set")
+	}
+	if len(query.Metrics) == 0 {
+		v.errorf(name, "class query must have metrics")
+	}
+	for _, mv := range query.Metrics {
+		v.validateMetric(name, mv, group)
+	}
+
+	if query.Aggregation != nil {
+		for _, labelName := range query.Aggregation.GroupBy {
+			if !labelNameRegex.MatchString(labelName) {
+				v.errorf(name, "aggregation group_by %q is not a valid label name", labelName)
+			}
+		}
+		if err := query.aggregationError(); err != nil {
+			v.errorf(name, "%s", err)
+		}
+	} else {
+		for _, mv := range query.Metrics {
+			if mv.Aggregation != "" {
+				v.warningf(name, "metric %s aggregation is only used with an aggregation block", mv.Name)
+			}
+		}
+	}
+
+	if query.Subscription {
+		if group {
+			v.warningf(name, "subscription is only supported for class queries and is ignored")
+		} else if strings.Contains(query.QueryParameter, "order-by") {
+			v.errorf(name, "subscription is not supported with order-by in query_parameter")
+		} else if strings.Contains(query.QueryParameter, "rsp-subtree") {
+			v.warningf(name, "subscription only update the attributes of %s, not the children", query.ClassName)
+		}
+	}
+
+	if query.NodeJoin != nil {
+		_, labelNames := query.NodeJoin.labels()
+		for _, labelName := range labelNames {
+			if !contains(nodeLabels, labelName) {
+				v.errorf(name, "node_join label %s is not valid, must be %s", labelName, strings.Join(nodeLabels, ", "))
+			}
+		}
+		if !viper.GetBool("node_cache.enabled") {
+			v.warningf(name, "node_join is only used if node_cache is enabled")
+		}
+	}
+
+	v.validateLabels(name, query.Labels)
+
+	for i, join := range query.Joins {
+		joinName := fmt.Sprintf("%s.joins[%d]", name, i)
+		if join.ClassName == "" {
+			v.errorf(joinName, "class_name must be set")
+		}
+		if len(join.Labels) == 0 {
+			v.warningf(joinName, "join has no labels and will not add any labels")
+		}
+		v.validateLabels(joinName, join.Labels)
+	}
+
+	v.validateStaticLabels(name, query.StaticLabels)
+
+	if group && query.Limits != nil {
+		v.warningf(name, "limits of a query in a group are ignored, the limits of the group apply")
+	} else {
+		v.validateLimits(name, query.Limits)
+	}
+	v.validateRelabelConfigs(name, query.RelabelConfigs)
+}
+
+func (v *configValidator) validateLabels(name string, labels []ConfigLabels) {
+	for _, lv := range labels {
+		if lv.PropertyName == "" {
+			v.errorf(name, "label property_name must be set")
+		}
+		re, err := regexp.Compile(lv.Regex)
+		if err != nil {
+			v.errorf(name, "label regex %q for %s is not valid - %s", lv.Regex, lv.PropertyName, err)
+			continue
+		}
+		named := false
+		for _, expName := range re.SubexpNames() {
+			if expName == "" {
+				continue
+			}
+			named = true
+			if !labelNameRegex.MatchString(expName) || strings.HasPrefix(expName, "__") {
+				v.errorf(name, "label %q in regex for %s is not a valid label name", expName, lv.PropertyName)
+			}
+		}
+		if !named {
+			v.warningf(name, "label regex %q for %s has no named groups and will not create any labels", lv.Regex,
+				lv.PropertyName)
+		}
+	}
+}
+
+func (v *configValidator) validateRelabelConfigs(name string, relabelConfigs []RelabelConfig) {
+	for i, rule := range relabelConfigs {
+		if err := rule.validate(); err != nil {
+			v.errorf(name, "relabel_configs[%d] %s", i, err)
+		}
+		for _, sourceLabel := range rule.SourceLabels {
+			if !labelNameRegex.MatchString(sourceLabel) {
+				v.errorf(name, "relabel_configs[%d] source label %q is not a valid label name", i, sourceLabel)
+			}
+		}
+	}
+}
+
+func (v *configValidator) validateLimits(name string, limits *QueryLimits) {
+	if limits == nil {
+		return
+	}
+	if err := limits.validate(); err != nil {
+		v.errorf(name, "%s", err)
+	}
+	if limits.MaxSeries < 0 || limits.MaxResponseBytes < 0 || limits.MaxPages < 0 {
+		v.errorf(name, "limits must not be negative")
+	}
+}
+
+func (v *configValidator) validateStaticLabels(name string, staticLabels []StaticLabels) {
+	for _, slv := range staticLabels {
+		if !labelNameRegex.MatchString(slv.Key) || strings.HasPrefix(slv.Key, "__") {
+			v.errorf(name, "static label %q is not a valid label name", slv.Key)
+		}
+	}
+}
+
+func (v *configValidator) validateMetricName(name string, metricName string, unit string, metricType string) {
+	fullName := v.prefix + metricName
+	if unit != "" {
+		fullName = fullName + "_" + unit
+	}
+	if metricName == "" || !metricNameRegex.MatchString(fullName) {
+		v.errorf(name, "metric name %q is not a valid metric name", fullName)
+	}
+	if !validMetricTypes[metricType] {
+		v.errorf(name, "metric %s type %q is not a valid type", metricName, metricType)
+	}
+}
+
+func (v *configValidator) validateMetric(name string, mv ConfigMetric, group bool) {
+	if !group {
+		v.validateMetricName(name, mv.Name, mv.Unit, mv.Type)
+	}
+
+	switch mv.Type {
+	case MetricTypeHistogram:
+		if len(mv.Buckets) == 0 {
+			v.errorf(name, "histogram %s must have buckets", mv.Name)
+		}
+		for _, bucket := range mv.Buckets {
+			if _, err := strconv.ParseFloat(bucket.UpperBound, 64); err != nil {
+				v.errorf(name, "histogram %s bucket le %q is not a number", mv.Name, bucket.UpperBound)
+			}
+			if bucket.ValueName == "" {
+				v.errorf(name, "histogram %s bucket %s must have a value_name", mv.Name, bucket.UpperBound)
+			}
+		}
+	case MetricTypeSummary:
+		if len(mv.Quantiles) == 0 {
+			v.errorf(name, "summary %s must have quantiles", mv.Name)
+		}
+		for _, quantile := range mv.Quantiles {
+			if quantile.Quantile < 0 || quantile.Quantile > 1 {
+				v.errorf(name, "summary %s quantile %g must be between 0 and 1", mv.Name, quantile.Quantile)
+			}
+			if quantile.ValueName == "" {
+				v.errorf(name, "summary %s quantile %g must have a value_name", mv.Name, quantile.Quantile)
+			}
+		}
+	case MetricTypeInfo:
+		if len(mv.Attributes) == 0 {
+			v.errorf(name, "info %s must have attributes", mv.Name)
+		}
+		for _, attribute := range mv.Attributes {
+			labelName := infoLabelName(attribute)
+			if !labelNameRegex.MatchString(labelName) || strings.HasPrefix(labelName, "__") {
+				v.errorf(name, "info %s attribute %q do not end with a valid label name", mv.Name, attribute)
+			}
+		}
+		if mv.ValueName != "" || mv.Unit != "" {
+			v.warningf(name, "info %s value_name and unit are not used", mv.Name)
+		}
+	default:
+		if mv.ValueName == "" && mv.ValueCalculation == "" && mv.Aggregation != AggregationCount {
+			v.warningf(name, "metric %s has no value_name", mv.Name)
+		}
+	}
+
+	if mv.Aggregation != "" && !validAggregations[mv.Aggregation] {
+		v.errorf(name, "metric %s aggregation %q is not valid, must be sum, count, min, max or avg", mv.Name,
+			mv.Aggregation)
+	}
+
+	// The names of the values that can be used in the value_calculation
+	valueNames := []string{"value"}
+	if mv.ValueRegexTransform != "" {
+		re, err := regexp.Compile(mv.ValueRegexTransform)
+		if err != nil {
+			v.errorf(name, "metric %s value_regex_transformation %q is not valid - %s", mv.Name,
+				mv.ValueRegexTransform, err)
+			return
+		}
+		if re.NumSubexp() == 0 {
+			v.errorf(name, "metric %s value_regex_transformation %q must have at least one group", mv.Name,
+				mv.ValueRegexTransform)
+		} else if re.NumSubexp() > 1 || re.SubexpNames()[1] != "" {
+			valueNames = nil
+			for index, expName := range re.SubexpNames()[1:] {
+				if expName == "" {
+					expName = fmt.Sprintf("value%d", index+1)
+				}
+				valueNames = append(valueNames, expName)
+			}
+		}
+	}
+
+	if mv.ValueCalculation != "" {
+		expression, err := govaluate.NewEvaluableExpression(mv.ValueCalculation)
+		if err != nil {
+			v.errorf(name, "metric %s value_calculation %q is not valid - %s", mv.Name, mv.ValueCalculation, err)
+			return
+		}
+		for _, variable := range expression.Vars() {
+			if !contains(valueNames, variable) {
+				v.errorf(name, "metric %s value_calculation use %q, only %s can be used", mv.Name, variable,
+					strings.Join(valueNames, ", "))
+			}
+		}
+	}
+}
+
+// dryRun execute the class and group queries against the saved responses in dataDir and print the resulting series.
+// The response of a class is read from the file <class_name>.json.
+func (v *configValidator) dryRun(allQueries AllQueries, dataDir string) {
+	api := aciAPI{
+		ctx:            context.Background(),
+		queryStatus:    newQueryStatus(),
+		relabelConfigs: allQueries.RelabelConfigs,
+	}
+	format := NewMetricFormat(false, viper.GetBool("metric_format.label_key_to_lower_case"),
+		viper.GetBool("metric_format.label_key_to_snake_case"))
+
+	for _, name := range sortedKeys(allQueries.ClassQueries) {
+		query := allQueries.ClassQueries[name]
+		data, ok := v.readData(name, query, dataDir)
+		if !ok {
+			continue
+		}
+		metricDefinitions := api.classMetricsFromData(query, data)
+		metricDefinitions = relabelMetrics(metricDefinitions, query.RelabelConfigs)
+		metricDefinitions = relabelMetrics(metricDefinitions, api.relabelConfigs)
+		fmt.Printf("# query %s\n%s", name, Metrics2Prometheus(metricDefinitions, v.prefix, nil, format))
+	}
+
+	for _, name := range sortedKeys(allQueries.GroupClassQueries) {
+		groupQuery := allQueries.GroupClassQueries[name]
+		metricDefinition := MetricDefinition{
+			Name: groupQuery.Name,
+			Description: MetricDesc{
+				Help: groupQuery.Help,
+				Type: groupQuery.Type,
+				Unit: groupQuery.Unit,
+			},
+		}
+		for i := range groupQuery.Queries {
+			query := &groupQuery.Queries[i]
+			data, ok := v.readData(fmt.Sprintf("%s.queries[%d]", name, i), query, dataDir)
+			if !ok {
+				continue
+			}
+			for _, md := range relabelMetrics(api.classMetricsFromData(query, data), query.RelabelConfigs) {
+				for _, metric := range md.Metrics {
+					for _, slv := range groupQuery.StaticLabels {
+						metric.Labels[slv.Key] = slv.Value
+					}
+				}
+				metricDefinition.Metrics = append(metricDefinition.Metrics, md.Metrics...)
+			}
+		}
+		metricDefinitions := relabelMetrics([]MetricDefinition{metricDefinition}, groupQuery.RelabelConfigs)
+		metricDefinitions = relabelMetrics(metricDefinitions, api.relabelConfigs)
+		fmt.Printf("# query %s\n%s", name, Metrics2Prometheus(metricDefinitions, v.prefix, nil, format))
+	}
+}
+
+// readData read the saved response of the class query and warn for value and property names that do not exist in
+// any of the objects
+func (v *configValidator) readData(name string, query *ClassQuery, dataDir string) (string, bool) {
+	fileName := filepath.Join(dataDir, query.ClassName+".json")
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		v.warningf(name, "no saved response for class %s - %s", query.ClassName, err)
+		return "", false
+	}
+	data := string(content)
+	if !gjson.Valid(data) {
+		v.errorf(name, "saved response %s is not valid json", fileName)
+		return "", false
+	}
+
+	objects := gjson.Get(data, "imdata").Array()
+	if len(objects) == 0 {
+		v.warningf(name, "saved response %s has no objects", fileName)
+		return data, true
+	}
+
+	var paths []string
+	for _, mv := range query.Metrics {
+		paths = append(paths, mv.ValueName, mv.SumValueName, mv.CountValueName)
+		for _, bucket := range mv.Buckets {
+			paths = append(paths, bucket.ValueName)
+		}
+		for _, quantile := range mv.Quantiles {
+			paths = append(paths, quantile.ValueName)
+		}
+	}
+	for _, lv := range query.Labels {
+		paths = append(paths, lv.PropertyName)
+	}
+
+	for _, path := range paths {
+		// Child expressions like fvAEPg.children.[healthInst].attributes.cur are not checked
+		if path == "" || arrayExtension.MatchString(path) {
+			continue
+		}
+		found := false
+		for _, object := range objects {
+			if gjson.Get(object.Raw, path).Exists() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.warningf(name, "%s do not exist in any object of %s", path, fileName)
+		}
+	}
+	return data, true
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}